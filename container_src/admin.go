@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// registerAdmin mounts the /admin endpoints. They exist only when
+// ADMIN_TOKEN is set and require it as a bearer token.
+func (s *Server) registerAdmin(handle func(method, path string, h http.HandlerFunc)) {
+	handle("POST", "/admin/shutdown", s.requireAdmin(s.handleShutdown))
+	handle("GET", "/admin/export", s.requireAdmin(s.handleExport))
+	handle("POST", "/admin/import", s.requireAdmin(s.handleImport))
+}
+
+// requireAdmin rejects requests that don't carry ADMIN_TOKEN as a bearer
+// token with 401.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleShutdown starts the same graceful shutdown as SIGTERM. The response
+// is still delivered, as shutdown waits for in-flight requests.
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("shutdown requested", "request_id", RequestIDFromContext(r.Context()), "client_ip", ClientIP(r))
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, "shutting down")
+}
+
+// counterExport is the body of /admin/export and /admin/import.
+type counterExport struct {
+	Visits *int `json:"visits"`
+}
+
+// handleExport returns the visit counter for migrating it to another
+// volume. Unlike /counter it fails rather than report the in-memory
+// fallback while storage is unavailable.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	visits, err := s.visits.Get()
+	if err != nil {
+		s.logger.Error("failed to export counter", "error", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "counter storage unavailable")
+		return
+	}
+	writeJSON(w, http.StatusOK, counterExport{Visits: &visits})
+}
+
+// handleImport sets the visit counter from a body in the format
+// /admin/export returns.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	var body counterExport
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, `body must be {"visits": N}`)
+		return
+	}
+	if body.Visits == nil || *body.Visits < 0 {
+		writeJSONError(w, http.StatusBadRequest, "visits must be a non-negative integer")
+		return
+	}
+	if err := s.visits.Set(*body.Visits); err != nil {
+		s.logger.Error("failed to import counter", "error", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "counter storage unavailable")
+		return
+	}
+	s.logger.Info("counter imported", "request_id", RequestIDFromContext(r.Context()),
+		"client_ip", ClientIP(r), "visits", *body.Visits)
+	writeJSON(w, http.StatusOK, body)
+}
+
+// ShutdownRequested is closed once /admin/shutdown has been called.
+func (s *Server) ShutdownRequested() <-chan struct{} {
+	return s.shutdown
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest builds a request to an /admin endpoint carrying token, if
+// set, as a bearer token.
+func adminRequest(method, target, token, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestAdminShutdown(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminToken = "s3cret"
+	s := newServer(cfg)
+	h := s.routes()
+
+	for _, token := range []string{"", "wrong"} {
+		w := record(h, adminRequest(http.MethodPost, "/admin/shutdown", token, ""))
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: status = %d, want 401 with WWW-Authenticate", token, w.Code)
+		}
+	}
+	select {
+	case <-s.ShutdownRequested():
+		t.Fatal("shutdown requested without the token")
+	default:
+	}
+
+	if w := record(h, adminRequest(http.MethodPost, "/admin/shutdown", "s3cret", "")); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", w.Code)
+	}
+	select {
+	case <-s.ShutdownRequested():
+	default:
+		t.Fatal("ShutdownRequested not closed")
+	}
+	// A second call must not close the channel again.
+	if w := record(h, adminRequest(http.MethodPost, "/admin/shutdown", "s3cret", "")); w.Code != http.StatusAccepted {
+		t.Errorf("second call: status = %d, want 202", w.Code)
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	if w := record(h, adminRequest(http.MethodPost, "/admin/shutdown", "", "")); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
+
+func TestAdminExportImport(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminToken = "s3cret"
+	h := newServer(cfg).routes()
+	for range 3 {
+		get(h, "/")
+	}
+
+	w := record(h, adminRequest(http.MethodGet, "/admin/export", "s3cret", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status = %d, want 200", w.Code)
+	}
+	exported := w.Body.String()
+	var body struct{ Visits int }
+	if err := json.Unmarshal([]byte(exported), &body); err != nil || body.Visits != 3 {
+		t.Fatalf("export body %q: %v, want 3 visits", exported, err)
+	}
+
+	// Import the export into a fresh volume.
+	cfg.StorageDir = t.TempDir()
+	h = newServer(cfg).routes()
+	if w := record(h, adminRequest(http.MethodPost, "/admin/import", "s3cret", exported)); w.Code != http.StatusOK {
+		t.Fatalf("import: status = %d %q, want 200", w.Code, w.Body)
+	}
+	if w := get(h, "/"); w.Header().Get("X-Visit-Count") != "4" {
+		t.Errorf("next visit = %q, want 4", w.Header().Get("X-Visit-Count"))
+	}
+}
+
+func TestAdminImportRejectsBadBodies(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminToken = "s3cret"
+	h := newServer(cfg).routes()
+	for _, body := range []string{`{"visits": -1}`, `{"visits": 1.5}`, `{}`, `{"visits": 1, "extra": true}`, `nope`} {
+		if w := record(h, adminRequest(http.MethodPost, "/admin/import", "s3cret", body)); w.Code != http.StatusBadRequest {
+			t.Errorf("import %s: status = %d, want 400", body, w.Code)
+		}
+	}
+	if w := record(h, adminRequest(http.MethodGet, "/admin/export", "", "")); w.Code != http.StatusUnauthorized {
+		t.Errorf("export without token: status = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authRequest builds a GET for target, with Basic Auth credentials unless
+// user is empty.
+func authRequest(target, user, pass string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	return r
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := basicAuthMiddleware(newServer(testConfig(t)).routes(), "admin", "hunter2", []string{"/metrics", "/admin/*"})
+
+	if w := record(h, authRequest("/metrics", "admin", "hunter2")); w.Code != http.StatusOK {
+		t.Errorf("right credentials: status = %d, want 200", w.Code)
+	}
+	for _, creds := range [][2]string{{"admin", "wrong"}, {"root", "hunter2"}, {"", ""}} {
+		w := record(h, authRequest("/metrics", creds[0], creds[1]))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("credentials %q: status = %d, want 401", creds, w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("credentials %q: no WWW-Authenticate", creds)
+		}
+	}
+	for _, target := range []string{"/", "/health"} {
+		if w := get(h, target); w.Code != http.StatusOK {
+			t.Errorf("public %s: status = %d, want 200", target, w.Code)
+		}
+	}
+}
+
+func TestPathMatches(t *testing.T) {
+	patterns := []string{"/env", "/admin/*"}
+	for path, want := range map[string]bool{
+		"/env":           true,
+		"/env/x":         false,
+		"/admin":         true,
+		"/admin/export":  true,
+		"/administrator": false,
+		"/":              false,
+	} {
+		if got := pathMatches(patterns, path); got != want {
+			t.Errorf("pathMatches(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestFailedLoginsAreRateLimited(t *testing.T) {
+	limiter := newRateLimiter(1, 3)
+	h := rateLimitMiddleware(
+		basicAuthMiddleware(newServer(testConfig(t)).routes(), "admin", "hunter2", []string{"/metrics"}),
+		func() *rateLimiter { return limiter })
+
+	for i := range 3 {
+		if w := record(h, authRequest("/metrics", "admin", "guess")); w.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: status = %d, want 401", i+1, w.Code)
+		}
+	}
+	if w := record(h, authRequest("/metrics", "admin", "guess")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("guess over the limit: status = %d, want 429", w.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIPMiddleware resolves the client address once per request. Proxy
+// headers are only honored when trustProxy is set, since anyone can send
+// them when the container is reachable directly.
+func clientIPMiddleware(next http.Handler, trustProxy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, trustProxy)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+	})
+}
+
+// ClientIP returns the client address resolved by clientIPMiddleware, or the
+// host part of RemoteAddr outside of it.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// resolveClientIP prefers CF-Connecting-IP, then the leftmost public
+// X-Forwarded-For entry, when trustProxy is set, and falls back to
+// RemoteAddr.
+func resolveClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); err == nil {
+			return ip.String()
+		}
+		for _, entry := range strings.Split(r.Header.Get("X-Forwarded-For"), ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(entry))
+			if err == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+				return ip.String()
+			}
+		}
+	}
+	return remoteHost(r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
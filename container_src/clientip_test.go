@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		trustProxy bool
+		want       string
+	}{
+		{"no headers", nil, true, "192.0.2.1"},
+		{"untrusted", map[string]string{"CF-Connecting-IP": "203.0.113.9"}, false, "192.0.2.1"},
+		{"cf-connecting-ip", map[string]string{"CF-Connecting-IP": "203.0.113.9", "X-Forwarded-For": "198.51.100.7"}, true, "203.0.113.9"},
+		{"leftmost public xff", map[string]string{"X-Forwarded-For": "10.0.0.1, 198.51.100.7, 203.0.113.9"}, true, "198.51.100.7"},
+		{"garbage xff", map[string]string{"X-Forwarded-For": "not-an-ip"}, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := resolveClientIP(r, tt.trustProxy); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	var got string
+	h := clientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r)
+	}), true)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	record(h, r)
+	if got != "198.51.100.7" {
+		t.Errorf("ClientIP = %q, want the forwarded address", got)
+	}
+}
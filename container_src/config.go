@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Config is the process configuration, read once at startup from defaults,
+// then the optional CONFIG_FILE, then env. The JSON names are what
+// CONFIG_FILE uses.
+type Config struct {
+	// LogLevel is the minimum level logged.
+	LogLevel slog.Level `json:"log_level"`
+
+	Message    string `json:"message"`
+	Secret     string `json:"secret"`
+	InstanceID string `json:"instance_id"`
+	Port       string `json:"port"`
+	StorageDir string `json:"storage_dir"`
+	// StorageDirMode and StorageFileMode are the permissions of directories
+	// and counter files created under StorageDir. Directories are subject
+	// to the umask.
+	StorageDirMode  fs.FileMode `json:"-"`
+	StorageFileMode fs.FileMode `json:"-"`
+	// DryRun keeps every counter in memory and never touches StorageDir, for
+	// running where no volume is mounted.
+	DryRun bool `json:"dry_run"`
+
+	// GreetingTemplate, when set, is a text/template for the plain-text
+	// greeting with .Message, .Secret, .Instance and .Visit.
+	GreetingTemplate string `json:"greeting_template"`
+
+	// HTTPEnabled serves plain HTTP on Port. It is always on unless TLS is
+	// configured, in which case a port must be set explicitly to run both.
+	HTTPEnabled bool   `json:"-"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	TLSPort     string `json:"tls_port"`
+	// EnableH2C also accepts HTTP/2 without TLS (prior knowledge) on Port.
+	EnableH2C bool `json:"enable_h2c"`
+
+	// BasePath prefixes every route, e.g. "/app". Empty serves from the
+	// root. HealthAtRoot keeps /health and /ready unprefixed.
+	BasePath     string `json:"base_path"`
+	HealthAtRoot bool   `json:"health_at_root"`
+	// SPAFallback serves the root response for unknown GET paths instead
+	// of 404.
+	SPAFallback bool `json:"spa_fallback"`
+
+	MaxRandomSize    int `json:"max_random_size"`
+	RandomChunkSize  int `json:"random_chunk_size"`
+	RandomFlushEvery int `json:"random_flush_every"`
+
+	// TrustProxyHeaders takes the client IP from CF-Connecting-IP or
+	// X-Forwarded-For. Only enable it behind a proxy that sets them.
+	TrustProxyHeaders bool `json:"trust_proxy_headers"`
+
+	// AsyncCounter keeps the visit counter in memory and persists it every
+	// AsyncFlushInterval and on shutdown.
+	AsyncCounter       bool          `json:"async_counter"`
+	AsyncFlushInterval time.Duration `json:"-"`
+
+	// GzipLevel is the compression level, 1 (fastest) to 9 (smallest).
+	GzipLevel int `json:"gzip_level"`
+
+	// MaxBodyBytes caps request bodies; larger ones get 413.
+	MaxBodyBytes int `json:"max_body_bytes"`
+	// MaxURLLength caps the request target, path plus query; longer ones
+	// get 414.
+	MaxURLLength int `json:"max_url_length"`
+
+	// ChaosMaxDelay, when positive, delays every request by a random
+	// duration between ChaosMinDelay and ChaosMaxDelay.
+	ChaosMinDelay time.Duration `json:"-"`
+	ChaosMaxDelay time.Duration `json:"-"`
+
+	// MaxAllocMB caps how much memory /mem may allocate per request.
+	MaxAllocMB int `json:"max_alloc_mb"`
+
+	// MaxConcurrent limits in-flight requests when positive.
+	MaxConcurrent int `json:"max_concurrent"`
+
+	// RateLimitRPS enables per-client rate limiting when positive.
+	RateLimitRPS   float64 `json:"rate_limit_rps"`
+	RateLimitBurst int     `json:"rate_limit_burst"`
+
+	// ExtraHeaders are added to every response.
+	ExtraHeaders map[string]string `json:"extra_headers"`
+
+	// CORSAllowedOrigins lists the origins allowed to call the server from
+	// a browser; "*" allows any. Empty disables CORS headers entirely.
+	CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+
+	// DisableError, DisableRandom and DisableDebug turn off /error and
+	// /slowpanic, /random, and the diagnostic endpoints such as /echo and
+	// /cpu; they then 404.
+	DisableError  bool `json:"disable_error"`
+	DisableRandom bool `json:"disable_random"`
+	DisableDebug  bool `json:"disable_debug"`
+
+	// AdminToken enables the /admin endpoints, which require it as a
+	// bearer token.
+	AdminToken string `json:"admin_token"`
+	// BasicAuthUser and BasicAuthPass, when both set, put BasicAuthPaths
+	// behind HTTP Basic Auth. Paths are relative to BasePath and may end in
+	// "/*" to cover everything below.
+	BasicAuthUser  string   `json:"basic_auth_user"`
+	BasicAuthPass  string   `json:"basic_auth_pass"`
+	BasicAuthPaths []string `json:"basic_auth_paths"`
+
+	AllowSecretReveal bool `json:"allow_secret_reveal"`
+	EnableReset       bool `json:"enable_reset"`
+	EnableEnvDebug    bool `json:"enable_env_debug"`
+	EnablePprof       bool `json:"enable_pprof"`
+
+	ReadHeaderTimeout time.Duration `json:"-"`
+	ReadTimeout       time.Duration `json:"-"`
+	WriteTimeout      time.Duration `json:"-"`
+	IdleTimeout       time.Duration `json:"-"`
+	ShutdownTimeout   time.Duration `json:"-"`
+	// RequestTimeout answers 503 to requests that run this long and cancels
+	// their context; 0 disables it. Paths in RequestTimeoutExempt, relative
+	// to BasePath, are never cut off.
+	RequestTimeout       time.Duration `json:"-"`
+	RequestTimeoutExempt []string      `json:"request_timeout_exempt"`
+	// Warmup is how long after boot /ready keeps reporting 503.
+	Warmup time.Duration `json:"-"`
+	// PrestopDelay is how long to keep serving, with /ready failing, after
+	// SIGTERM and before shutting down, so the load balancer can deregister
+	// the instance first.
+	PrestopDelay time.Duration `json:"-"`
+}
+
+const defaultPort = "80"
+
+// defaultConfig is the configuration with nothing set.
+func defaultConfig() Config {
+	return Config{
+		Port:       defaultPort,
+		StorageDir: "/storage",
+		TLSPort:    "443",
+
+		StorageDirMode:  0755,
+		StorageFileMode: 0644,
+
+		MaxRandomSize:    defaultMaxRandomSize,
+		RandomChunkSize:  64 * 1024,
+		RandomFlushEvery: 16,
+
+		GzipLevel:    6,
+		MaxBodyBytes: 1 << 20,
+		MaxURLLength: 8192,
+		MaxAllocMB:   256,
+
+		AsyncFlushInterval: time.Second,
+
+		// WriteTimeout bounds the whole response, so it defaults high enough
+		// for large /random downloads; lower it and big downloads get cut off
+		// mid-stream.
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       120 * time.Second,
+		ShutdownTimeout:   10 * time.Second,
+
+		RequestTimeout:       30 * time.Second,
+		RequestTimeoutExempt: []string{"/stream", "/random"},
+
+		// /admin needs its bearer token in the same Authorization header, so
+		// it can't sit behind Basic Auth too.
+		BasicAuthPaths: []string{"/env", "/metrics", "/debug/pprof/*"},
+	}
+}
+
+// LoadConfig builds the configuration from defaults, the JSON file named by
+// CONFIG_FILE if there is one, and env, each overriding the last.
+//
+// Values that can't be right, such as an unparseable number, an out-of-range
+// limit, a malformed config file or an unreadable MYSECRET_FILE, are hard
+// errors: all of them are returned joined so the process can refuse to
+// start. Missing optional settings are soft: MESSAGE, MYSECRET and
+// CONFIG_FILE's file may be absent, and malformed EXTRA_HEADERS entries are
+// skipped, each with a warning.
+func LoadConfig() (Config, error) {
+	var env envReader
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		fileCfg := cfg
+		switch err := loadConfigFile(path, &fileCfg); {
+		case errors.Is(err, fs.ErrNotExist):
+			slog.Info("config file not found, using env only", "path", path)
+		case err != nil:
+			env.errs = append(env.errs, fmt.Errorf("CONFIG_FILE %s: %w", path, err))
+		default:
+			cfg = fileCfg
+		}
+	}
+
+	cfg.LogLevel = env.level("LOG_LEVEL", cfg.LogLevel)
+	cfg.Message = envString("MESSAGE", cfg.Message)
+	cfg.GreetingTemplate = envString("GREETING_TEMPLATE", cfg.GreetingTemplate)
+	cfg.Secret = envString("MYSECRET", cfg.Secret)
+	if path := os.Getenv("MYSECRET_FILE"); path != "" {
+		// A mounted secret file keeps the value out of the process env and
+		// wins over MYSECRET.
+		if data, err := os.ReadFile(path); err != nil {
+			env.errs = append(env.errs, fmt.Errorf("MYSECRET_FILE: %w", err))
+		} else {
+			cfg.Secret = strings.TrimRight(string(data), " \t\r\n")
+		}
+	}
+	cfg.InstanceID = envString("CLOUDFLARE_DEPLOYMENT_ID", cfg.InstanceID)
+	cfg.Port = env.port("PORT", cfg.Port)
+	cfg.StorageDir = envString("STORAGE_DIR", cfg.StorageDir)
+	cfg.StorageDirMode = env.fileMode("STORAGE_DIR_MODE", cfg.StorageDirMode)
+	cfg.StorageFileMode = env.fileMode("STORAGE_FILE_MODE", cfg.StorageFileMode)
+	cfg.DryRun = env.bool("DRY_RUN", cfg.DryRun)
+
+	cfg.TLSCertFile = envString("TLS_CERT_FILE", cfg.TLSCertFile)
+	cfg.TLSKeyFile = envString("TLS_KEY_FILE", cfg.TLSKeyFile)
+	cfg.TLSPort = env.port("TLS_PORT", cfg.TLSPort)
+	cfg.EnableH2C = env.bool("ENABLE_H2C", cfg.EnableH2C)
+
+	cfg.BasePath = envString("BASE_PATH", cfg.BasePath)
+	cfg.HealthAtRoot = env.bool("HEALTH_AT_ROOT", cfg.HealthAtRoot)
+	cfg.SPAFallback = env.bool("SPA_FALLBACK", cfg.SPAFallback)
+
+	cfg.MaxRandomSize = env.int("MAX_RANDOM_SIZE", cfg.MaxRandomSize)
+	cfg.RandomChunkSize = env.int("RANDOM_CHUNK_SIZE", cfg.RandomChunkSize)
+	cfg.RandomFlushEvery = env.int("RANDOM_FLUSH_EVERY", cfg.RandomFlushEvery)
+
+	cfg.TrustProxyHeaders = env.bool("TRUST_PROXY_HEADERS", cfg.TrustProxyHeaders)
+
+	cfg.AsyncCounter = env.bool("ASYNC_COUNTER", cfg.AsyncCounter)
+	cfg.AsyncFlushInterval = env.millis("ASYNC_COUNTER_FLUSH_MS", cfg.AsyncFlushInterval, 1)
+
+	cfg.GzipLevel = env.int("GZIP_LEVEL", cfg.GzipLevel)
+	cfg.MaxBodyBytes = env.int("MAX_BODY_BYTES", cfg.MaxBodyBytes)
+	cfg.MaxURLLength = env.int("MAX_URL_LENGTH", cfg.MaxURLLength)
+	cfg.ChaosMinDelay = env.millis("CHAOS_MIN_MS", cfg.ChaosMinDelay, 0)
+	cfg.ChaosMaxDelay = env.millis("CHAOS_MAX_MS", cfg.ChaosMaxDelay, 0)
+	cfg.MaxAllocMB = env.int("MAX_ALLOC_MB", cfg.MaxAllocMB)
+	cfg.MaxConcurrent = env.nonNegativeInt("MAX_CONCURRENT", cfg.MaxConcurrent)
+	cfg.RateLimitRPS = env.nonNegativeFloat("RATE_LIMIT_RPS", cfg.RateLimitRPS)
+	if cfg.RateLimitBurst <= 0 {
+		// Without an explicit burst, allow one second's worth of requests.
+		cfg.RateLimitBurst = max(1, int(math.Ceil(cfg.RateLimitRPS)))
+	}
+	cfg.RateLimitBurst = env.int("RATE_LIMIT_BURST", cfg.RateLimitBurst)
+
+	if spec := os.Getenv("EXTRA_HEADERS"); spec != "" {
+		cfg.ExtraHeaders = parseExtraHeaders(spec)
+	} else if cfg.ExtraHeaders != nil {
+		cfg.ExtraHeaders = checkExtraHeaders(cfg.ExtraHeaders)
+	}
+	cfg.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS", cfg.CORSAllowedOrigins)
+
+	cfg.DisableError = env.bool("DISABLE_ERROR", cfg.DisableError)
+	cfg.DisableRandom = env.bool("DISABLE_RANDOM", cfg.DisableRandom)
+	cfg.DisableDebug = env.bool("DISABLE_DEBUG", cfg.DisableDebug)
+
+	cfg.AdminToken = envString("ADMIN_TOKEN", cfg.AdminToken)
+	cfg.BasicAuthUser = envString("BASIC_AUTH_USER", cfg.BasicAuthUser)
+	cfg.BasicAuthPass = envString("BASIC_AUTH_PASS", cfg.BasicAuthPass)
+	cfg.BasicAuthPaths = envList("BASIC_AUTH_PATHS", cfg.BasicAuthPaths)
+	cfg.AllowSecretReveal = env.bool("ALLOW_SECRET_REVEAL", cfg.AllowSecretReveal)
+	cfg.EnableReset = env.bool("ENABLE_RESET", cfg.EnableReset)
+	cfg.EnableEnvDebug = env.bool("ENABLE_ENV_DEBUG", cfg.EnableEnvDebug)
+	cfg.EnablePprof = env.bool("ENABLE_PPROF", cfg.EnablePprof)
+
+	cfg.ReadHeaderTimeout = env.seconds("READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout, 1)
+	cfg.ReadTimeout = env.seconds("READ_TIMEOUT", cfg.ReadTimeout, 1)
+	cfg.WriteTimeout = env.seconds("WRITE_TIMEOUT", cfg.WriteTimeout, 1)
+	cfg.IdleTimeout = env.seconds("IDLE_TIMEOUT", cfg.IdleTimeout, 1)
+	cfg.ShutdownTimeout = env.seconds("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout, 1)
+	cfg.RequestTimeout = env.seconds("REQUEST_TIMEOUT", cfg.RequestTimeout, 0)
+	cfg.RequestTimeoutExempt = envList("REQUEST_TIMEOUT_EXEMPT", cfg.RequestTimeoutExempt)
+	cfg.PrestopDelay = env.seconds("PRESTOP_DELAY", cfg.PrestopDelay, 0)
+	cfg.Warmup = env.seconds("WARMUP_SECONDS", cfg.Warmup, 0)
+
+	// Values from the file get the same cleanup as values from env.
+	cfg.Message = sanitizeMessage(cfg.Message)
+	if cfg.Message == "" {
+		slog.Warn("MESSAGE is not set")
+	}
+	if cfg.Secret == "" {
+		slog.Warn("MYSECRET is not set")
+	}
+	cfg.BasePath = normalizeBasePath(cfg.BasePath)
+	cfg.HTTPEnabled = !cfg.TLSEnabled() || cfg.Port != defaultPort || os.Getenv("PORT") != ""
+	return cfg, errors.Join(append(env.errs, cfg.validate()...)...)
+}
+
+// validate checks the invariants env parsing can't, covering values from
+// CONFIG_FILE too.
+func (c Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(validPort(c.Port), "port %q is not a valid TCP port", c.Port)
+	check(validPort(c.TLSPort), "TLS port %q is not a valid TCP port", c.TLSPort)
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "TLS needs both TLS_CERT_FILE and TLS_KEY_FILE")
+	check((c.BasicAuthUser == "") == (c.BasicAuthPass == ""), "Basic Auth needs both BASIC_AUTH_USER and BASIC_AUTH_PASS")
+	for _, f := range []struct {
+		name string
+		v    int
+	}{
+		{"MAX_RANDOM_SIZE", c.MaxRandomSize},
+		{"RANDOM_CHUNK_SIZE", c.RandomChunkSize},
+		{"RANDOM_FLUSH_EVERY", c.RandomFlushEvery},
+		{"MAX_BODY_BYTES", c.MaxBodyBytes},
+		{"MAX_URL_LENGTH", c.MaxURLLength},
+		{"MAX_ALLOC_MB", c.MaxAllocMB},
+		{"RATE_LIMIT_BURST", c.RateLimitBurst},
+	} {
+		check(f.v > 0, "%s must be positive, got %d", f.name, f.v)
+	}
+	// Zero disables REQUEST_TIMEOUT, PRESTOP_DELAY, WARMUP_SECONDS and the
+	// chaos delays, but these need a real value.
+	for _, f := range []struct {
+		name string
+		v    time.Duration
+	}{
+		{"ASYNC_COUNTER_FLUSH_MS", c.AsyncFlushInterval},
+		{"READ_HEADER_TIMEOUT", c.ReadHeaderTimeout},
+		{"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout},
+		{"IDLE_TIMEOUT", c.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+	} {
+		check(f.v > 0, "%s must be positive, got %s", f.name, f.v)
+	}
+	check(c.MaxConcurrent >= 0, "MAX_CONCURRENT must not be negative, got %d", c.MaxConcurrent)
+	check(c.RateLimitRPS >= 0 && !math.IsInf(c.RateLimitRPS, 0), "RATE_LIMIT_RPS must be a non-negative number, got %v", c.RateLimitRPS)
+	check(c.GzipLevel >= gzip.BestSpeed && c.GzipLevel <= gzip.BestCompression,
+		"GZIP_LEVEL must be between %d and %d, got %d", gzip.BestSpeed, gzip.BestCompression, c.GzipLevel)
+	check(c.ChaosMinDelay <= c.ChaosMaxDelay || c.ChaosMaxDelay == 0,
+		"CHAOS_MIN_MS (%s) exceeds CHAOS_MAX_MS (%s)", c.ChaosMinDelay, c.ChaosMaxDelay)
+	return errs
+}
+
+// fileDurations holds the Config durations as they appear in CONFIG_FILE:
+// strings such as "30s" rather than nanosecond counts.
+type fileDurations struct {
+	AsyncFlushInterval *jsonDuration `json:"async_counter_flush_interval"`
+	ReadHeaderTimeout  *jsonDuration `json:"read_header_timeout"`
+	ReadTimeout        *jsonDuration `json:"read_timeout"`
+	WriteTimeout       *jsonDuration `json:"write_timeout"`
+	IdleTimeout        *jsonDuration `json:"idle_timeout"`
+	ShutdownTimeout    *jsonDuration `json:"shutdown_timeout"`
+	RequestTimeout     *jsonDuration `json:"request_timeout"`
+	ChaosMinDelay      *jsonDuration `json:"chaos_min_delay"`
+	ChaosMaxDelay      *jsonDuration `json:"chaos_max_delay"`
+	PrestopDelay       *jsonDuration `json:"prestop_delay"`
+	Warmup             *jsonDuration `json:"warmup"`
+}
+
+// loadConfigFile overlays the JSON file at path onto cfg. Keys missing from
+// the file leave cfg unchanged; unknown keys are an error so typos don't go
+// unnoticed.
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		*Config
+		fileDurations
+	}
+	file.Config = cfg
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		src *jsonDuration
+		dst *time.Duration
+	}{
+		{file.fileDurations.AsyncFlushInterval, &cfg.AsyncFlushInterval},
+		{file.fileDurations.ReadHeaderTimeout, &cfg.ReadHeaderTimeout},
+		{file.fileDurations.ReadTimeout, &cfg.ReadTimeout},
+		{file.fileDurations.WriteTimeout, &cfg.WriteTimeout},
+		{file.fileDurations.IdleTimeout, &cfg.IdleTimeout},
+		{file.fileDurations.ShutdownTimeout, &cfg.ShutdownTimeout},
+		{file.fileDurations.RequestTimeout, &cfg.RequestTimeout},
+		{file.fileDurations.ChaosMinDelay, &cfg.ChaosMinDelay},
+		{file.fileDurations.ChaosMaxDelay, &cfg.ChaosMaxDelay},
+		{file.fileDurations.PrestopDelay, &cfg.PrestopDelay},
+		{file.fileDurations.Warmup, &cfg.Warmup},
+	} {
+		if d.src != nil {
+			*d.dst = time.Duration(*d.src)
+		}
+	}
+	return nil
+}
+
+// jsonDuration decodes a duration string such as "1m30s".
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("duration %q must not be negative", s)
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// Addr is the address the HTTP server listens on.
+func (c Config) Addr() string {
+	return ":" + c.Port
+}
+
+// TLSEnabled reports whether both a certificate and key were configured.
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// LogValue reduces secrets to whether they are set, so a Config is always
+// safe to log.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("log_level", c.LogLevel.String()),
+		slog.String("port", c.Port),
+		slog.Bool("http_enabled", c.HTTPEnabled),
+		slog.Bool("tls_enabled", c.TLSEnabled()),
+		slog.String("tls_port", c.TLSPort),
+		slog.Bool("h2c_enabled", c.EnableH2C),
+		slog.String("storage_dir", c.StorageDir),
+		slog.Bool("dry_run", c.DryRun),
+		slog.Bool("message_set", c.Message != ""),
+		slog.Bool("secret_set", c.Secret != ""),
+		slog.Bool("admin_enabled", c.AdminToken != ""),
+		slog.Bool("basic_auth_enabled", c.BasicAuthUser != ""),
+		slog.String("instance_id", c.InstanceID),
+	)
+}
+
+// maxMessageBytes caps MESSAGE so a misconfigured value cannot bloat every
+// response.
+const maxMessageBytes = 4 << 10
+
+// sanitizeMessage strips invalid UTF-8 and control characters from MESSAGE,
+// which is echoed into responses and logs, and truncates it to
+// maxMessageBytes. Line breaks and tabs become spaces. A warning is logged
+// when anything was removed.
+func sanitizeMessage(m string) string {
+	clean := stripControl(m)
+	if clean != m {
+		slog.Warn("removed control characters or invalid UTF-8 from MESSAGE")
+	}
+	if len(clean) > maxMessageBytes {
+		slog.Warn("MESSAGE truncated", "bytes", len(clean), "max", maxMessageBytes)
+		clean = truncateUTF8(clean, maxMessageBytes)
+	}
+	return clean
+}
+
+// stripControl drops invalid UTF-8 and control characters from s, turning
+// line breaks and tabs into spaces.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+}
+
+// truncateUTF8 cuts s to at most n bytes, backing off to a rune boundary so
+// the cut doesn't leave a partial character behind.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// normalizeBasePath turns "app", "/app" and "/app/" into "/app", and "/"
+// into "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// parseExtraHeaders parses a comma-separated list of "Name: value" headers,
+// as in EXTRA_HEADERS="X-Foo: bar, X-Baz: qux". Malformed entries are
+// skipped with a warning. Values therefore can't contain commas.
+func parseExtraHeaders(spec string) map[string]string {
+	headers := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		if !ok {
+			slog.Warn("skipping malformed EXTRA_HEADERS entry", "entry", entry)
+			continue
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return checkExtraHeaders(headers)
+}
+
+// checkExtraHeaders canonicalizes the header names and drops, with a
+// warning, entries that aren't valid HTTP headers.
+func checkExtraHeaders(headers map[string]string) map[string]string {
+	valid := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !validHeaderName(name) || !validHeaderValue(value) {
+			slog.Warn("skipping malformed EXTRA_HEADERS entry", "entry", name+": "+value)
+			continue
+		}
+		valid[http.CanonicalHeaderKey(name)] = value
+	}
+	return valid
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue rejects control characters, which could split headers.
+func validHeaderValue(value string) bool {
+	for _, c := range value {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// envString reads the named env var, falling back to def when it is unset.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList reads a comma-separated list from the named env var, falling back
+// to def when it is unset. Blank entries are dropped.
+func envList(name string, def []string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envReader reads typed env vars. An unset var yields the default; a var
+// that doesn't parse also yields the default but is recorded in errs.
+type envReader struct {
+	errs []error
+}
+
+// lookup returns the named var, or ok=false when it is unset.
+func (e *envReader) lookup(name string) (string, bool) {
+	v := os.Getenv(name)
+	return v, v != ""
+}
+
+func (e *envReader) invalid(name, value, want string) {
+	e.errs = append(e.errs, fmt.Errorf("%s=%q: must be %s", name, value, want))
+}
+
+// level reads a log level: debug, info, warn or error.
+func (e *envReader) level(name string, def slog.Level) slog.Level {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		e.invalid(name, v, "debug, info, warn or error")
+		return def
+	}
+	return level
+}
+
+func (e *envReader) bool(name string, def bool) bool {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.invalid(name, v, "true or false")
+		return def
+	}
+	return b
+}
+
+// port reads a TCP port number.
+func (e *envReader) port(name, def string) string {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	if !validPort(v) {
+		e.invalid(name, v, "a port between 1 and 65535")
+		return def
+	}
+	return v
+}
+
+func validPort(v string) bool {
+	n, err := strconv.Atoi(v)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// int reads a positive integer.
+func (e *envReader) int(name string, def int) int {
+	return e.intAtLeast(name, def, 1)
+}
+
+// nonNegativeInt reads an integer that may be zero.
+func (e *envReader) nonNegativeInt(name string, def int) int {
+	return e.intAtLeast(name, def, 0)
+}
+
+func (e *envReader) intAtLeast(name string, def, least int) int {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < least {
+		e.invalid(name, v, fmt.Sprintf("an integer of at least %d", least))
+		return def
+	}
+	return n
+}
+
+// fileMode reads permission bits as an octal string such as 0640.
+func (e *envReader) fileMode(name string, def fs.FileMode) fs.FileMode {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > uint64(fs.ModePerm) {
+		e.invalid(name, v, "octal permission bits between 0 and 0777")
+		return def
+	}
+	return fs.FileMode(mode)
+}
+
+// nonNegativeFloat reads a finite number that may be zero.
+func (e *envReader) nonNegativeFloat(name string, def float64) float64 {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		e.invalid(name, v, "a non-negative number")
+		return def
+	}
+	return f
+}
+
+// seconds reads a whole number of seconds, no fewer than least. def is
+// returned as is, so a sub-second default from CONFIG_FILE survives.
+func (e *envReader) seconds(name string, def time.Duration, least int) time.Duration {
+	return e.duration(name, def, least, time.Second)
+}
+
+// millis reads a whole number of milliseconds, no fewer than least.
+func (e *envReader) millis(name string, def time.Duration, least int) time.Duration {
+	return e.duration(name, def, least, time.Millisecond)
+}
+
+func (e *envReader) duration(name string, def time.Duration, least int, unit time.Duration) time.Duration {
+	v, ok := e.lookup(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < least {
+		e.invalid(name, v, fmt.Sprintf("an integer of at least %d", least))
+		return def
+	}
+	return time.Duration(n) * unit
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestConfigStartupLog(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("STORAGE_DIR", "/data")
+	t.Setenv("MESSAGE", "hello")
+	t.Setenv("MYSECRET", "hunter2")
+	t.Setenv("CLOUDFLARE_DEPLOYMENT_ID", "i-1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("starting", "config", cfg)
+	var entry struct {
+		Config map[string]any `json:"config"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"port":        "9090",
+		"storage_dir": "/data",
+		"message_set": true,
+		"secret_set":  true,
+		"instance_id": "i-1",
+	}
+	for k, v := range want {
+		if entry.Config[k] != v {
+			t.Errorf("config.%s = %v, want %v", k, entry.Config[k], v)
+		}
+	}
+	if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), "hello") {
+		t.Errorf("startup log leaks values: %s", buf.String())
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "80" || cfg.Addr() != ":80" || !cfg.HTTPEnabled {
+		t.Errorf("port %q, addr %q, HTTP %v; want 80 with plain HTTP on", cfg.Port, cfg.Addr(), cfg.HTTPEnabled)
+	}
+	if cfg.StorageDir != "/storage" {
+		t.Errorf("StorageDir = %q, want /storage", cfg.StorageDir)
+	}
+	if cfg.Message != "" || cfg.Secret != "" || cfg.InstanceID != "" {
+		t.Errorf("message %q, secret %q, instance %q; want all empty", cfg.Message, cfg.Secret, cfg.InstanceID)
+	}
+	if cfg.MaxRandomSize != defaultMaxRandomSize || cfg.RandomChunkSize != 64<<10 || cfg.RandomFlushEvery != 16 {
+		t.Errorf("random limits %d/%d/%d, want the defaults", cfg.MaxRandomSize, cfg.RandomChunkSize, cfg.RandomFlushEvery)
+	}
+	if cfg.ShutdownTimeout != 10*time.Second {
+		t.Errorf("ShutdownTimeout = %v, want 10s", cfg.ShutdownTimeout)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("MESSAGE", "hello")
+	t.Setenv("MYSECRET", "hunter2")
+	t.Setenv("MAX_RANDOM_SIZE", "2048")
+	t.Setenv("SHUTDOWN_TIMEOUT", "3")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Message != "hello" || cfg.Secret != "hunter2" || cfg.MaxRandomSize != 2048 || cfg.ShutdownTimeout != 3*time.Second {
+		t.Errorf("got message %q, secret %q, max size %d, shutdown %v", cfg.Message, cfg.Secret, cfg.MaxRandomSize, cfg.ShutdownTimeout)
+	}
+}
+
+func TestSanitizeMessage(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"hello", "hello"},
+		{"line one\nline two\r\n", "line one line two  "},
+		{"bell\a and esc\x1b[31m", "bell and esc[31m"},
+		{"bad \xff utf8", "bad  utf8"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeMessage(tt.in); got != tt.want {
+			t.Errorf("sanitizeMessage(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	long := strings.Repeat("é", maxMessageBytes) // two bytes each
+	got := sanitizeMessage(long)
+	if len(got) > maxMessageBytes || !utf8.ValidString(got) {
+		t.Errorf("long message: %d bytes, valid UTF-8 %v", len(got), utf8.ValidString(got))
+	}
+}
+
+func TestLoadConfigSanitizesMessage(t *testing.T) {
+	logs := captureLogs(t)
+	t.Setenv("MESSAGE", "hi\nINFO forged log line")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Message != "hi INFO forged log line" {
+		t.Errorf("Message = %q", cfg.Message)
+	}
+	findLog(t, logs, "removed control characters or invalid UTF-8 from MESSAGE")
+}
+
+// writeConfigFile writes content to a temp CONFIG_FILE for the test.
+func writeConfigFile(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	writeConfigFile(t, `{"message": "from file", "port": "8080", "read_timeout": "45s"}`)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Message != "from file" || cfg.Port != "8080" || cfg.ReadTimeout != 45*time.Second {
+		t.Errorf("message %q, port %q, read timeout %v; want the file's values", cfg.Message, cfg.Port, cfg.ReadTimeout)
+	}
+	if cfg.StorageDir != "/storage" {
+		t.Errorf("StorageDir = %q, want the default for a key the file lacks", cfg.StorageDir)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	writeConfigFile(t, `{"message": "from file", "port": "8080"}`)
+	t.Setenv("MESSAGE", "from env")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Message != "from env" || cfg.Port != "8080" {
+		t.Errorf("message %q, port %q; want env's message and the file's port", cfg.Message, cfg.Port)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "absent.json"))
+	if _, err := LoadConfig(); err != nil {
+		t.Errorf("missing CONFIG_FILE: %v", err)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for _, content := range []string{`{"mesage": "typo"}`, `{"read_timeout": 30}`, `not json`,
+		`{"read_timeout": "0s"}`, `{"request_timeout": "-1s"}`} {
+		writeConfigFile(t, content)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("CONFIG_FILE %s loaded without error", content)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := new(slog.LevelVar)
+	newLiveConfig(cfg, level)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+	logger.Info("suppressed")
+	logger.Warn("kept")
+	if out := buf.String(); strings.Contains(out, "suppressed") || !strings.Contains(out, "kept") {
+		t.Errorf("at warn level logged %q", out)
+	}
+
+	t.Setenv("LOG_LEVEL", "loud")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LOG_LEVEL=loud accepted")
+	}
+}
+
+func TestLoadConfigSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MYSECRET", "from-env")
+	t.Setenv("MYSECRET_FILE", path)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Secret != "from-file" {
+		t.Errorf("Secret = %q, want the trimmed file contents", cfg.Secret)
+	}
+
+	t.Setenv("MYSECRET_FILE", filepath.Join(t.TempDir(), "absent"))
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "MYSECRET_FILE") {
+		t.Errorf("unreadable MYSECRET_FILE: err = %v", err)
+	}
+}
+
+func TestLoadConfigGzipLevel(t *testing.T) {
+	t.Setenv("GZIP_LEVEL", "1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GzipLevel != 1 {
+		t.Errorf("GzipLevel = %d, want 1", cfg.GzipLevel)
+	}
+	for _, v := range []string{"10", "fast"} {
+		t.Setenv("GZIP_LEVEL", v)
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "GZIP_LEVEL") {
+			t.Errorf("GZIP_LEVEL=%s: err = %v", v, err)
+		}
+	}
+}
+
+func TestLoadConfigFileSubSecondDurations(t *testing.T) {
+	writeConfigFile(t, `{"read_header_timeout": "500ms", "async_counter_flush_interval": "1500us"}`)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ReadHeaderTimeout != 500*time.Millisecond {
+		t.Errorf("ReadHeaderTimeout = %v, want 500ms", cfg.ReadHeaderTimeout)
+	}
+	if cfg.AsyncFlushInterval != 1500*time.Microsecond {
+		t.Errorf("AsyncFlushInterval = %v, want 1.5ms", cfg.AsyncFlushInterval)
+	}
+
+	// The env var, when set, still wins in whole units.
+	t.Setenv("READ_HEADER_TIMEOUT", "2")
+	if cfg, err := LoadConfig(); err != nil || cfg.ReadHeaderTimeout != 2*time.Second {
+		t.Errorf("ReadHeaderTimeout = %v, %v; want 2s", cfg.ReadHeaderTimeout, err)
+	}
+}
+
+func TestLoadConfigStorageModes(t *testing.T) {
+	t.Setenv("STORAGE_DIR_MODE", "0750")
+	t.Setenv("STORAGE_FILE_MODE", "0640")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.StorageDirMode != 0o750 || cfg.StorageFileMode != 0o640 {
+		t.Errorf("modes = %o, %o; want 750, 640", cfg.StorageDirMode, cfg.StorageFileMode)
+	}
+	for _, v := range []string{"999", "rw-r--r--", "01777"} {
+		t.Setenv("STORAGE_FILE_MODE", v)
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "STORAGE_FILE_MODE") {
+			t.Errorf("STORAGE_FILE_MODE=%s: err = %v", v, err)
+		}
+	}
+}
+
+func TestLoadConfigMaxURLLength(t *testing.T) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxURLLength != 8192 {
+		t.Errorf("default MaxURLLength = %d, want 8192", cfg.MaxURLLength)
+	}
+	t.Setenv("MAX_URL_LENGTH", "0")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("MAX_URL_LENGTH=0 accepted")
+	}
+}
+
+func TestLoadConfigFileZeroDurations(t *testing.T) {
+	writeConfigFile(t, `{"request_timeout": "0s", "prestop_delay": "0s", "warmup": "0s", "chaos_min_delay": "0s", "chaos_max_delay": "0s"}`)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RequestTimeout != 0 || cfg.PrestopDelay != 0 || cfg.Warmup != 0 {
+		t.Errorf("RequestTimeout %v, PrestopDelay %v, Warmup %v; want all 0", cfg.RequestTimeout, cfg.PrestopDelay, cfg.Warmup)
+	}
+}
+
+func TestLoadConfigHardErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"bad port", map[string]string{"PORT": "abc"}, "PORT"},
+		{"port out of range", map[string]string{"PORT": "70000"}, "PORT"},
+		{"negative limit", map[string]string{"MAX_CONCURRENT": "-1"}, "MAX_CONCURRENT"},
+		{"zero body limit", map[string]string{"MAX_BODY_BYTES": "0"}, "MAX_BODY_BYTES"},
+		{"bad rate", map[string]string{"RATE_LIMIT_RPS": "fast"}, "RATE_LIMIT_RPS"},
+		{"bad bool", map[string]string{"DRY_RUN": "maybe"}, "DRY_RUN"},
+		{"chaos bounds", map[string]string{"CHAOS_MIN_MS": "50", "CHAOS_MAX_MS": "10"}, "CHAOS_MIN_MS"},
+		{"unreadable secret file", map[string]string{"MYSECRET_FILE": "/nonexistent/secret"}, "MYSECRET_FILE"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want one naming %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigJoinsErrors(t *testing.T) {
+	t.Setenv("PORT", "abc")
+	t.Setenv("MAX_BODY_BYTES", "-5")
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("LoadConfig succeeded")
+	}
+	for _, name := range []string{"PORT", "MAX_BODY_BYTES"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("err = %v, want %s reported too", err, name)
+		}
+	}
+}
+
+func TestLoadConfigSoftMissing(t *testing.T) {
+	logs := captureLogs(t)
+	t.Setenv("MESSAGE", "")
+	t.Setenv("MYSECRET", "")
+	t.Setenv("EXTRA_HEADERS", "X-Ok: yes, malformed")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig with optional settings missing: %v", err)
+	}
+	if cfg.Message != "" || cfg.Secret != "" || len(cfg.ExtraHeaders) != 1 {
+		t.Errorf("message %q, secret %q, headers %v; want defaults and X-Ok only", cfg.Message, cfg.Secret, cfg.ExtraHeaders)
+	}
+	for _, msg := range []string{"MESSAGE is not set", "MYSECRET is not set", "skipping malformed EXTRA_HEADERS entry"} {
+		findLog(t, logs, msg)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browser code may read.
+var corsExposedHeaders = strings.Join([]string{
+	"Content-Range",
+	"ETag",
+	"X-Content-SHA256",
+	"X-Request-Id",
+	"X-Visit-Count",
+}, ", ")
+
+// corsMiddleware adds CORS headers for requests whose Origin is in allowed,
+// which may contain "*" to allow any origin, and answers preflight requests
+// from those origins with 204. Other origins get no CORS headers, so the
+// browser blocks the response.
+func corsMiddleware(next http.Handler, allowed []string) http.Handler {
+	allowAll := slices.Contains(allowed, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !allowAll {
+			// The response differs by Origin, so caches must key on it.
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin == "" || !(allowAll || slices.Contains(allowed, origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if allowAll {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", reqHeaders)
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
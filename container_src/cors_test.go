@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	h := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), []string{"https://app.example"})
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		return record(h, r)
+	}
+
+	w := request(http.MethodGet, "https://app.example")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("allowed origin: Access-Control-Allow-Origin = %q", got)
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("Vary = %q, want Origin", w.Header().Get("Vary"))
+	}
+
+	w = request(http.MethodGet, "https://evil.example")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin: Access-Control-Allow-Origin = %q", got)
+	}
+
+	w = request(http.MethodOptions, "https://app.example")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("preflight = %d with Allow-Methods %q, want 204 and the methods", w.Code, w.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
+
+func TestCORSMiddlewareWildcard(t *testing.T) {
+	h := corsMiddleware(http.NotFoundHandler(), []string{"*"})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://any.example")
+	if got := record(h, r).Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CounterStore is a monotonically increasing counter.
+type CounterStore interface {
+	// Increment adds one to the counter and returns the new value.
+	Increment() (int, error)
+	// Get returns the current value without changing it.
+	Get() (int, error)
+	// Reset sets the counter back to zero.
+	Reset() error
+	// Set overwrites the counter with n.
+	Set(n int) error
+}
+
+// lockProber is implemented by stores guarded by a mutex, so /health can
+// detect one that has been held for too long.
+type lockProber interface {
+	// lockFree reports whether the store's lock could be taken within
+	// timeout. The lock is released again straight away.
+	lockFree(timeout time.Duration) bool
+}
+
+// tryLockWithin polls mu with TryLock until it succeeds or timeout passes.
+func tryLockWithin(mu *sync.Mutex, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if mu.TryLock() {
+			mu.Unlock()
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// errStorageUnavailable is returned, wrapped, by FileCounterStore when the
+// counter file can't be read or written.
+var errStorageUnavailable = errors.New("storage unavailable")
+
+// FileCounterStore keeps the count in a file. Every read/increment/write
+// cycle runs under mu so concurrent requests never observe the same value.
+//
+// When the file can't be read or written the store keeps counting in memory:
+// Increment then returns the in-memory value together with an error wrapping
+// errStorageUnavailable. Once storage recovers counting resumes from the file.
+type FileCounterStore struct {
+	path     string
+	dirMode  fs.FileMode
+	fileMode fs.FileMode
+	logger   *slog.Logger
+
+	mu  sync.Mutex
+	mem int // last value handed out, the fallback while storage is down
+}
+
+// NewFileCounterStore returns a store persisting its count at path, creating
+// the file with fileMode and any missing parent dirs with dirMode.
+func NewFileCounterStore(path string, dirMode, fileMode fs.FileMode, logger *slog.Logger) *FileCounterStore {
+	return &FileCounterStore{path: path, dirMode: dirMode, fileMode: fileMode, logger: logger}
+}
+
+func (c *FileCounterStore) Increment() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter, err := c.read()
+	if err == nil {
+		counter++
+		// Write new counter
+		err = c.write(counter)
+	}
+	if err != nil {
+		c.mem++
+		return c.mem, err
+	}
+	c.mem = counter
+	return counter, nil
+}
+
+func (c *FileCounterStore) Get() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter, err := c.read()
+	if err != nil {
+		return c.mem, err
+	}
+	return counter, nil
+}
+
+func (c *FileCounterStore) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mem = 0
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (c *FileCounterStore) lockFree(timeout time.Duration) bool {
+	return tryLockWithin(&c.mu, timeout)
+}
+
+func (c *FileCounterStore) Set(n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.write(n); err != nil {
+		return err
+	}
+	c.mem = n
+	return nil
+}
+
+// read returns the stored value. A missing file counts as zero. So does a
+// corrupt one: it is logged and overwritten with 0 straight away, so the
+// corruption is reported once and counting carries on from there.
+func (c *FileCounterStore) read() (int, error) {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		c.logger.Warn("failed to read counter file", "path", c.path, "error", err)
+		return 0, fmt.Errorf("%w: %v", errStorageUnavailable, err)
+	}
+	count, err := decodeCounter(data)
+	if err != nil {
+		c.logger.Error("counter file is corrupt, resetting it to zero", "path", c.path, "content", truncate(data, 64), "error", err)
+		if err := c.write(0); err != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return count, nil
+}
+
+func (c *FileCounterStore) write(counter int) error {
+	if err := os.MkdirAll(filepath.Dir(c.path), c.dirMode); err != nil {
+		c.logger.Warn("failed to create counter dir", "path", c.path, "error", err)
+		return fmt.Errorf("%w: %v", errStorageUnavailable, err)
+	}
+	if err := writeFileAtomic(c.path, encodeCounter(counter), c.fileMode); err != nil {
+		c.logger.Warn("failed to write counter file", "path", c.path, "error", err)
+		return fmt.Errorf("%w: %v", errStorageUnavailable, err)
+	}
+	return nil
+}
+
+// The counter file holds "value:checksum", the checksum being the CRC-32 of
+// the decimal value in hex, so a torn or bit-flipped write is detected rather
+// than trusted. Files holding just a number, from before checksums, are
+// still accepted.
+
+func encodeCounter(n int) []byte {
+	v := strconv.Itoa(n)
+	return fmt.Appendf(nil, "%s:%08x\n", v, crc32.ChecksumIEEE([]byte(v)))
+}
+
+// decodeCounter parses either counter file format, rejecting negative values
+// and checksum mismatches.
+func decodeCounter(data []byte) (int, error) {
+	v, sum, checksummed := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if checksummed {
+		want, err := strconv.ParseUint(sum, 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid checksum %q", sum)
+		}
+		if got := crc32.ChecksumIEEE([]byte(v)); got != uint32(want) {
+			return 0, fmt.Errorf("checksum mismatch: stored %08x, computed %08x", want, got)
+		}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", v)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative value %d", n)
+	}
+	return n, nil
+}
+
+// truncate returns data as a string of at most n bytes, for logging file
+// contents that may be arbitrarily large.
+func truncate(data []byte, n int) string {
+	if len(data) > n {
+		return string(data[:n]) + "..."
+	}
+	return string(data)
+}
+
+// AsyncCounterStore counts in memory and persists to a FileCounterStore in
+// the background, trading durability of the last few increments for not
+// touching disk on every request. Flush must be called on shutdown.
+//
+// If the file can't be read at startup the store counts up from zero in the
+// meantime and reports errStorageUnavailable, and won't write the file until
+// a later Flush manages to read it and adds the increments on top. A
+// shutdown before then loses them, but never overwrites the persisted count.
+type AsyncCounterStore struct {
+	file *FileCounterStore
+
+	// flushMu serializes writes to file. Flush holds only it during the
+	// write, so requests keep counting under mu meanwhile.
+	flushMu sync.Mutex
+
+	mu     sync.Mutex
+	n      int
+	dirty  bool
+	loaded bool // n includes the file's value, not just increments since boot
+}
+
+// NewAsyncCounterStore starts counting from file's current value.
+func NewAsyncCounterStore(file *FileCounterStore) *AsyncCounterStore {
+	c := &AsyncCounterStore{file: file}
+	if n, err := file.Get(); err == nil {
+		c.n, c.loaded = n, true
+	}
+	return c
+}
+
+func (c *AsyncCounterStore) Increment() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	c.dirty = true
+	return c.n, c.loadErr()
+}
+
+func (c *AsyncCounterStore) Get() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n, c.loadErr()
+}
+
+// loadErr reports a count that doesn't include the file's value yet. The
+// caller holds mu.
+func (c *AsyncCounterStore) loadErr() error {
+	if !c.loaded {
+		return fmt.Errorf("%w: counter file not read yet", errStorageUnavailable)
+	}
+	return nil
+}
+
+// Reset and Set hold mu across their disk write, unlike Flush, so an
+// increment can't slip in between the file changing and the memory
+// following it. They are admin operations, rare enough for the stall.
+
+func (c *AsyncCounterStore) Reset() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Reset(); err != nil {
+		return err
+	}
+	c.n, c.dirty, c.loaded = 0, false, true
+	return nil
+}
+
+// Set writes n through to the file straight away rather than waiting for
+// the next flush, so an import is durable once it returns.
+func (c *AsyncCounterStore) Set(n int) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Set(n); err != nil {
+		return err
+	}
+	c.n, c.dirty, c.loaded = n, false, true
+	return nil
+}
+
+// lockFree checks the in-memory lock, the one requests wait on. Only Reset
+// and Set hold it while writing, so a stuck flush doesn't show up here.
+func (c *AsyncCounterStore) lockFree(timeout time.Duration) bool {
+	return tryLockWithin(&c.mu, timeout)
+}
+
+// Flush writes the in-memory value to the file if it changed since the last
+// flush, first reading the file if that failed at startup. A failed write
+// leaves the value dirty for the next flush.
+func (c *AsyncCounterStore) Flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	if err := c.load(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	n, dirty := c.n, c.dirty
+	c.dirty = false
+	c.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	if err := c.file.Set(n); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// load adds the file's value to the increments counted since boot, if that
+// hasn't happened yet. The caller holds flushMu.
+func (c *AsyncCounterStore) load() error {
+	c.mu.Lock()
+	loaded := c.loaded
+	c.mu.Unlock()
+	if loaded {
+		return nil
+	}
+	base, err := c.file.Get()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.n += base
+	c.loaded = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Run flushes every interval until ctx is done. The final flush is left to
+// the caller, once no more requests can increment the counter.
+func (c *AsyncCounterStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// MemoryCounterStore is a CounterStore that lives only as long as the
+// process.
+type MemoryCounterStore struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *MemoryCounterStore) Increment() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n, nil
+}
+
+func (c *MemoryCounterStore) Get() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n, nil
+}
+
+func (c *MemoryCounterStore) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n = 0
+	return nil
+}
+
+func (c *MemoryCounterStore) Set(n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n = n
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place, so a crash mid-write never leaves path truncated.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileCounterStoreRecoversFromTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "visit_counter.txt")
+	// A write cut off halfway through the checksum.
+	if err := os.WriteFile(path, []byte("1234:9f3"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileCounterStore(path, 0o755, 0o644, slog.Default())
+
+	n, err := store.Increment()
+	if err != nil || n != 1 {
+		t.Fatalf("Increment() = %d, %v; want 1, nil", n, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decodeCounter(data); err != nil || got != 1 {
+		t.Errorf("stored counter = %d, %v; want 1", got, err)
+	}
+}
+
+func TestWriteFileAtomicLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "visit_counter.txt")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "second" {
+		t.Errorf("content = %q, want %q", data, "second")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir holds %d entries, want just the counter file", len(entries))
+	}
+}
+
+// testStores returns one of each CounterStore, starting from zero.
+func testStores(t *testing.T) map[string]CounterStore {
+	return map[string]CounterStore{
+		"file":   NewFileCounterStore(filepath.Join(t.TempDir(), "c.txt"), 0o755, 0o644, slog.Default()),
+		"memory": &MemoryCounterStore{},
+		"async":  NewAsyncCounterStore(NewFileCounterStore(filepath.Join(t.TempDir(), "a.txt"), 0o755, 0o644, slog.Default())),
+	}
+}
+
+func TestCounterStoreContract(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if n, err := store.Get(); err != nil || n != 0 {
+				t.Errorf("fresh Get() = %d, %v; want 0", n, err)
+			}
+			for want := 1; want <= 3; want++ {
+				if n, err := store.Increment(); err != nil || n != want {
+					t.Errorf("Increment() = %d, %v; want %d", n, err, want)
+				}
+			}
+			if n, err := store.Get(); err != nil || n != 3 {
+				t.Errorf("Get() = %d, %v; want 3", n, err)
+			}
+			if err := store.Set(10); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := store.Increment(); n != 11 {
+				t.Errorf("Increment() after Set(10) = %d, want 11", n)
+			}
+			if err := store.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := store.Increment(); n != 1 {
+				t.Errorf("Increment() after Reset = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestCounterStoreIncrementsAreUnique(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			const n = 100
+			seen := make(chan int, n)
+			var wg sync.WaitGroup
+			for range n {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					v, _ := store.Increment()
+					seen <- v
+				}()
+			}
+			wg.Wait()
+			close(seen)
+			got := make(map[int]bool)
+			for v := range seen {
+				if got[v] {
+					t.Errorf("value %d handed out twice", v)
+				}
+				got[v] = true
+			}
+			if v, _ := store.Get(); v != n {
+				t.Errorf("Get() = %d, want %d", v, n)
+			}
+		})
+	}
+}
+
+func TestAsyncCounterStoreFlush(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AsyncCounter = true
+	s := newServer(cfg)
+	h := s.routes()
+	for range 25 {
+		get(h, "/")
+	}
+	if data, err := os.ReadFile(counterPath(cfg.StorageDir)); err == nil {
+		t.Errorf("counter written before any flush: %q", data)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(counterPath(cfg.StorageDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := decodeCounter(data); err != nil || n != 25 {
+		t.Errorf("persisted %d, %v; want 25", n, err)
+	}
+}
+
+func TestAsyncCounterStoreUnreadableAtStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.txt")
+	// A directory in the file's place makes every read fail.
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := NewFileCounterStore(path, 0o755, 0o644, slog.Default())
+	store := NewAsyncCounterStore(file)
+
+	for range 3 {
+		if _, err := store.Increment(); !errors.Is(err, errStorageUnavailable) {
+			t.Errorf("Increment() error = %v, want errStorageUnavailable", err)
+		}
+	}
+	if err := store.Flush(); err == nil {
+		t.Error("Flush() succeeded without reading the file")
+	}
+
+	// Storage comes back holding the count from before the restart.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, encodeCounter(40), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := file.Get(); err != nil || n != 43 {
+		t.Errorf("persisted %d, %v; want 43", n, err)
+	}
+	if n, err := store.Increment(); err != nil || n != 44 {
+		t.Errorf("Increment() = %d, %v; want 44, nil", n, err)
+	}
+}
+
+func TestDecodeCounter(t *testing.T) {
+	if n, err := decodeCounter(encodeCounter(42)); err != nil || n != 42 {
+		t.Errorf("round trip = %d, %v; want 42", n, err)
+	}
+	if n, err := decodeCounter([]byte("17\n")); err != nil || n != 17 {
+		t.Errorf("legacy file = %d, %v; want 17", n, err)
+	}
+	for _, data := range []string{"42:00000000\n", "42:zz\n", "-1\n", "x\n"} {
+		if _, err := decodeCounter([]byte(data)); err == nil {
+			t.Errorf("decodeCounter(%q) succeeded, want an error", data)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	// The runtime image has no zoneinfo, so /time?tz= needs the embedded
+	// database.
+	_ "time/tzdata"
+)
+
+// maxSleep bounds /sleep so a caller can't park a goroutine forever.
+const maxSleep = 30 * time.Second
+
+// sleepParam reads a millisecond duration such as the ?ms=N shared by
+// /sleep and /delay-headers, capped at maxSleep.
+func sleepParam(r *http.Request, name string) (time.Duration, bool) {
+	ms, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return min(time.Duration(ms)*time.Millisecond, maxSleep), true
+}
+
+// handleSleep waits ?ms=N milliseconds before responding, returning early if
+// the client goes away.
+func (s *Server) handleSleep(w http.ResponseWriter, r *http.Request) {
+	d, ok := sleepParam(r, "ms")
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "ms must be a non-negative integer")
+		return
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		s.logger.Info("sleep cancelled", "requested", d.String(), "slept", time.Since(start).String())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "slept %s", time.Since(start))
+}
+
+// handleDelayHeaders waits ?ms=N milliseconds before sending anything, not
+// even the status line, so clients' response-header timeouts can be tested.
+// Unlike /sleep it then streams a body, flushed right after the headers.
+func (s *Server) handleDelayHeaders(w http.ResponseWriter, r *http.Request) {
+	d, ok := sleepParam(r, "ms")
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "ms must be a non-negative integer")
+		return
+	}
+	if !sleepUntil(r.Context(), time.Now().Add(d)) {
+		s.logger.Info("delay-headers cancelled", "requested", d.String())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+	fmt.Fprintf(w, "headers delayed %s", d)
+}
+
+// maxEchoBody caps how much of the request body /echo reflects.
+const maxEchoBody = 64 << 10
+
+// echoSkipHeaders are left out of /echo: hop-by-hop headers describe the
+// connection rather than the request, and credentials must not be reflected.
+var echoSkipHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// handleEcho describes the incoming request as JSON, so it's easy to see what
+// a proxy in front of the container forwarded.
+func (s *Server) handleEcho(w http.ResponseWriter, r *http.Request) {
+	headers := make(map[string][]string)
+	for name, values := range r.Header {
+		if !echoSkipHeaders[name] {
+			headers[name] = values
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBody+1))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	truncated := len(body) > maxEchoBody
+	if truncated {
+		body = body[:maxEchoBody]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"method":         r.Method,
+		"path":           r.URL.Path,
+		"query":          r.URL.Query(),
+		"headers":        headers,
+		"body":           string(body),
+		"body_truncated": truncated,
+	})
+}
+
+// handleWhoami reports which process and socket answered the request and
+// who it thinks the client is, for diagnosing container networking.
+func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		s.logger.Warn("failed to read hostname", "error", err)
+	}
+	localAddr := ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr.String()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"hostname":      hostname,
+		"local_addr":    localAddr,
+		"deployment_id": s.cfg.InstanceID,
+		"instance_uuid": instanceUUID,
+		"client_ip":     ClientIP(r),
+	})
+}
+
+// handleTime reports the server clock in RFC 3339, in UTC or in the IANA
+// zone named by ?tz=.
+func (s *Server) handleTime(w http.ResponseWriter, r *http.Request) {
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown time zone %q", tz))
+			return
+		}
+	}
+
+	now := time.Now().In(loc)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"time":     now.Format(time.RFC3339),
+		"timezone": loc.String(),
+		"unix":     now.Unix(),
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSleepReturnsEarlyOnCancel(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	record(h, httptest.NewRequestWithContext(ctx, http.MethodGet, "/sleep?ms=10000", nil))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sleep ran %v after cancellation", elapsed)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	w := get(newServer(testConfig(t)).routes(), "/sleep?ms=20")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	v, _ := strings.CutPrefix(w.Body.String(), "slept ")
+	if slept, err := time.ParseDuration(v); err != nil || slept < 20*time.Millisecond {
+		t.Errorf("body = %q, want the slept duration of at least 20ms", w.Body)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	r := httptest.NewRequest(http.MethodPost, "/echo?a=1", strings.NewReader("hello"))
+	r.Header.Set("X-Custom", "yes")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("Connection", "keep-alive")
+	w := record(h, r)
+
+	var got struct {
+		Method  string              `json:"method"`
+		Path    string              `json:"path"`
+		Query   map[string][]string `json:"query"`
+		Headers map[string][]string `json:"headers"`
+		Body    string              `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %q: %v", w.Body, err)
+	}
+	if got.Method != "POST" || got.Path != "/echo" || got.Query["a"][0] != "1" || got.Body != "hello" {
+		t.Errorf("echo = %+v", got)
+	}
+	if got.Headers["X-Custom"] == nil {
+		t.Error("X-Custom not reflected")
+	}
+	for _, name := range []string{"Authorization", "Cookie", "Connection"} {
+		if got.Headers[name] != nil {
+			t.Errorf("%s reflected", name)
+		}
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("credentials leaked: %s", w.Body)
+	}
+}
+
+func TestPprofGating(t *testing.T) {
+	cfg := testConfig(t)
+	if w := get(newServer(cfg).routes(), "/debug/pprof/"); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status = %d, want 404", w.Code)
+	}
+
+	cfg.EnablePprof = true
+	cfg.BasePath = "/app"
+	w := get(newServer(cfg).routes(), "/app/debug/pprof/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("enabled: status = %d, want the 200 profile index", w.Code)
+	}
+}
+
+func TestDelayHeadersClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(newServer(testConfig(t)).routes())
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}}
+	start := time.Now()
+	resp, err := client.Get(srv.URL + "/delay-headers?ms=2000")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("got %d before the delay, want a header timeout", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("client waited %v, want it to give up at the header timeout", elapsed)
+	}
+
+	resp, err = http.Get(srv.URL + "/delay-headers?ms=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("short delay: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.InstanceID = "deploy-1"
+	var got map[string]string
+	if err := json.Unmarshal(get(newServer(cfg).routes(), "/whoami").Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if got["hostname"] != hostname || got["deployment_id"] != "deploy-1" || got["client_ip"] != "192.0.2.1" {
+		t.Errorf("whoami = %v, want hostname %q, deployment deploy-1 and the test client IP", got, hostname)
+	}
+}
+
+func TestTime(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	timeIn := func(query string) (zone string, at time.Time) {
+		var body struct{ Time, Timezone string }
+		if err := json.Unmarshal(get(h, "/time"+query).Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse(time.RFC3339, body.Time)
+		if err != nil {
+			t.Fatalf("time %q: %v", body.Time, err)
+		}
+		return body.Timezone, at
+	}
+
+	if zone, at := timeIn(""); zone != "UTC" || !strings.HasSuffix(at.Format(time.RFC3339), "Z") {
+		t.Errorf("default: zone %q, time %v; want UTC", zone, at)
+	}
+	zone, at := timeIn("?tz=America/New_York")
+	if _, offset := at.Zone(); zone != "America/New_York" || offset > -4*3600 {
+		t.Errorf("New York: zone %q, time %v", zone, at)
+	}
+	if w := get(h, "/time?tz=Mars/Olympus"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid tz: status = %d, want 400", w.Code)
+	}
+}
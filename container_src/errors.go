@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes the {"error": msg} envelope every error response
+// uses. Like http.Error it drops any Content-Length the handler had already
+// set for its intended body.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSONBody(w, status, map[string]string{"error": msg})
+}
+
+func writeJSONBody(w http.ResponseWriter, status int, body map[string]string) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, body)
+}
+
+// notFound writes the JSON 404 body used for unknown routes.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeRouteError(w, r, http.StatusNotFound)
+}
+
+// writeRouteError extends the error envelope with the path, and for a 405
+// the method, that didn't match.
+func writeRouteError(w http.ResponseWriter, r *http.Request, status int) {
+	body := map[string]string{"error": "not found", "path": r.URL.Path}
+	if status == http.StatusMethodNotAllowed {
+		body = map[string]string{"error": "method not allowed", "path": r.URL.Path, "method": r.Method}
+	}
+	writeJSONBody(w, status, body)
+}
+
+// jsonRouteErrors replaces the mux's plain-text 404 and 405 responses with
+// JSON bodies. The mux still decides the status, and its Allow header is kept;
+// other responses for unmatched requests, such as redirects, are untouched.
+//
+// If fallback is set, GET and HEAD requests that would 404 are served by it
+// instead, SPA style; registered routes and 405s are unaffected.
+func jsonRouteErrors(mux *http.ServeMux, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// No route matched: run the mux's error handler against a scratch
+		// writer to learn the status it would send.
+		rec := &headerRecorder{header: make(http.Header)}
+		h.ServeHTTP(rec, r)
+		if rec.status != http.StatusNotFound && rec.status != http.StatusMethodNotAllowed {
+			// Redirects to the cleaned path and the like go out as the
+			// mux wrote them.
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if fallback != nil && rec.status == http.StatusNotFound &&
+			(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		if allow := rec.header.Get("Allow"); allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		writeRouteError(w, r, rec.status)
+	})
+}
+
+// headerRecorder is a ResponseWriter that keeps the status and headers and
+// drops the body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (h *headerRecorder) Header() http.Header { return h.header }
+
+func (h *headerRecorder) WriteHeader(code int) {
+	if h.status == 0 {
+		h.status = code
+	}
+}
+
+func (h *headerRecorder) Write(b []byte) (int, error) {
+	h.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
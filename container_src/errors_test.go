@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// decodeError decodes a JSON error envelope, checking its content type.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", w.Body, err)
+	}
+	return body
+}
+
+func TestJSONNotFound(t *testing.T) {
+	h := jsonRouteErrors(newServer(testConfig(t)).routes(), nil)
+	for _, target := range []string{"/nope", "/container/extra"} {
+		w := get(h, target)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", target, w.Code)
+		}
+		body := decodeError(t, w)
+		if body["error"] != "not found" || body["path"] != target {
+			t.Errorf("GET %s: body = %v", target, body)
+		}
+	}
+}
+
+func TestJSONMethodNotAllowed(t *testing.T) {
+	h := jsonRouteErrors(newServer(testConfig(t)).routes(), nil)
+	w := record(h, httptest.NewRequest(http.MethodDelete, "/random", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("Allow = %q, want \"GET, HEAD\"", allow)
+	}
+	body := decodeError(t, w)
+	if body["error"] != "method not allowed" || body["path"] != "/random" || body["method"] != "DELETE" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	s := newServer(testConfig(t))
+	h := jsonRouteErrors(s.routes(), http.HandlerFunc(s.handleRoot))
+
+	w := get(h, "/app/settings")
+	if w.Code != http.StatusOK || w.Header().Get("X-Visit-Count") != "1" {
+		t.Errorf("GET /app/settings = %d with visit %q, want the root response", w.Code, w.Header().Get("X-Visit-Count"))
+	}
+	if w := get(h, "/health"); w.Code != http.StatusOK || w.Header().Get("X-Visit-Count") != "" {
+		t.Errorf("GET /health = %d with visit %q, want the health response", w.Code, w.Header().Get("X-Visit-Count"))
+	}
+	if w := get(h, "/random?size=8"); w.Code != http.StatusOK || w.Body.Len() != 8 {
+		t.Errorf("GET /random = %d with %d bytes, want 8 random bytes", w.Code, w.Body.Len())
+	}
+	// Only GET and HEAD fall back.
+	if w := record(h, httptest.NewRequest(http.MethodPost, "/app/settings", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("POST /app/settings = %d, want 404", w.Code)
+	}
+}
+
+func TestSPAFallbackDisabled(t *testing.T) {
+	h := jsonRouteErrors(newServer(testConfig(t)).routes(), nil)
+	if w := get(h, "/app/settings"); w.Code != http.StatusNotFound || w.Header().Get("X-Visit-Count") != "" {
+		t.Errorf("GET /app/settings = %d with visit %q, want a 404 without a visit", w.Code, w.Header().Get("X-Visit-Count"))
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Length", "123")
+	writeJSONError(w, http.StatusTeapot, "short and stout")
+	if w.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want 418", w.Code)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("stale Content-Length %q kept", cl)
+	}
+	if body := decodeError(t, w); len(body) != 1 || body["error"] != "short and stout" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestHandlerErrorsUseEnvelope(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	for _, target := range []string{"/random?size=abc", "/?status=abc", "/sleep?ms=-1"} {
+		w := get(h, target)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d, want 400", target, w.Code)
+			continue
+		}
+		if body := decodeError(t, w); body["error"] == "" {
+			t.Errorf("GET %s: body = %v, want an error message", target, body)
+		}
+	}
+}
+
+func TestJSONRouteErrorsKeepsRedirects(t *testing.T) {
+	s := newServer(testConfig(t))
+	for _, fallback := range []http.Handler{nil, http.HandlerFunc(s.handleRoot)} {
+		h := jsonRouteErrors(s.routes(), fallback)
+		for _, target := range []string{"//nope", "/a/../nope"} {
+			w := get(h, target)
+			if w.Code < 300 || w.Code > 399 || w.Header().Get("Location") == "" {
+				t.Errorf("GET %s: status = %d with Location %q, want a redirect", target, w.Code, w.Header().Get("Location"))
+			}
+			if w.Header().Get("X-Visit-Count") != "" {
+				t.Errorf("GET %s: redirect counted a visit", target)
+			}
+		}
+	}
+}
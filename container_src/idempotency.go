@@ -0,0 +1,74 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyTTL      = 10 * time.Minute
+	idempotencyCapacity = 1024
+	maxIdempotencyKey   = 255
+)
+
+// idempotencyCache remembers the visit number handed out for each recent
+// Idempotency-Key, so a retried request gets the same number instead of
+// counting twice. It holds at most capacity keys, evicting the least
+// recently used, and forgets keys after ttl.
+type idempotencyCache struct {
+	ttl      time.Duration
+	capacity int
+
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type idempotencyEntry struct {
+	key     string
+	visit   int
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, capacity int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:      ttl,
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// do returns the visit recorded for key, with replayed set, or else calls
+// increment and records its result. The lock is held across increment so
+// concurrent retries with the same key can't both count. Failed increments
+// aren't recorded, so a retry counts again.
+func (c *idempotencyCache) do(key string, now time.Time, increment func() (int, error)) (visit int, replayed bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*idempotencyEntry)
+		if now.Before(entry.expires) {
+			c.order.MoveToFront(el)
+			return entry.visit, true, nil
+		}
+		c.remove(el)
+	}
+
+	visit, err = increment()
+	if err != nil {
+		return visit, false, err
+	}
+	c.items[key] = c.order.PushFront(&idempotencyEntry{key: key, visit: visit, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+	return visit, false, nil
+}
+
+func (c *idempotencyCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*idempotencyEntry).key)
+}
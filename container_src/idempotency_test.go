@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCacheExpiryAndEviction(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 2)
+	n := 0
+	increment := func() (int, error) { n++; return n, nil }
+	now := time.Now()
+
+	c.do("a", now, increment)
+	if v, replayed, _ := c.do("a", now.Add(59*time.Second), increment); v != 1 || !replayed {
+		t.Errorf("within TTL: %d, replayed %v; want 1, true", v, replayed)
+	}
+	if v, replayed, _ := c.do("a", now.Add(time.Minute), increment); v != 2 || replayed {
+		t.Errorf("after TTL: %d, replayed %v; want 2, false", v, replayed)
+	}
+
+	c.do("b", now, increment)
+	c.do("c", now, increment) // evicts a, the least recently used
+	if _, replayed, _ := c.do("a", now, increment); replayed {
+		t.Error("a survived eviction")
+	}
+}
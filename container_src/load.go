@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxCPUWorkers = 64
+
+// handleCPU keeps ?workers=W goroutines (default 1) busy hashing for ?ms=N
+// milliseconds, at most maxSleep, to drive CPU-based autoscaling. All workers
+// stop early if the client goes away.
+func (s *Server) handleCPU(w http.ResponseWriter, r *http.Request) {
+	d, ok := sleepParam(r, "ms")
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "ms must be a non-negative integer")
+		return
+	}
+	workers := 1
+	if v := r.URL.Query().Get("workers"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxCPUWorkers {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("workers must be an integer between 1 and %d", maxCPUWorkers))
+			return
+		}
+		workers = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	start := time.Now()
+	var hashes atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hashes.Add(burn(ctx))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if r.Context().Err() != nil {
+		s.logger.Info("cpu burn cancelled", "requested", d.String(), "burned", elapsed.String(), "workers", workers)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"requested_ms": d.Milliseconds(),
+		"elapsed_ms":   elapsed.Milliseconds(),
+		"workers":      workers,
+		"hashes":       hashes.Load(),
+	})
+}
+
+// burn hashes in a tight loop until ctx is done and returns how many hashes
+// it computed. ctx is only checked every 1024 hashes to keep the loop hot.
+func burn(ctx context.Context) int64 {
+	var sum [sha256.Size]byte
+	var n int64
+	for {
+		for range 1024 {
+			sum = sha256.Sum256(sum[:])
+		}
+		n += 1024
+		if ctx.Err() != nil {
+			return n
+		}
+	}
+}
+
+// defaultHoldAlloc is how long /mem keeps its allocation when ?hold_ms= is
+// not given.
+const defaultHoldAlloc = time.Second
+
+// handleMem allocates ?mb=N megabytes, at most MAX_ALLOC_MB, touches every
+// page so it is really resident, holds it for ?hold_ms= milliseconds (1s by
+// default, at most maxSleep) and then releases it back to the OS.
+func (s *Server) handleMem(w http.ResponseWriter, r *http.Request) {
+	mb, err := strconv.Atoi(r.URL.Query().Get("mb"))
+	if err != nil || mb <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "mb must be a positive integer")
+		return
+	}
+	if mb > s.cfg.MaxAllocMB {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("mb %d exceeds the maximum of %d", mb, s.cfg.MaxAllocMB))
+		return
+	}
+	hold := defaultHoldAlloc
+	if r.URL.Query().Has("hold_ms") {
+		var ok bool
+		if hold, ok = sleepParam(r, "hold_ms"); !ok {
+			writeJSONError(w, http.StatusBadRequest, "hold_ms must be a non-negative integer")
+			return
+		}
+	}
+
+	buf := make([]byte, mb<<20)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = 1
+	}
+	s.logger.Info("memory allocated", "request_id", RequestIDFromContext(r.Context()), "mb", mb, "hold", hold.String())
+	held := sleepUntil(r.Context(), time.Now().Add(hold))
+	// buf is unreachable after this, so the forced collection frees it.
+	runtime.KeepAlive(buf)
+	debug.FreeOSMemory()
+
+	if !held {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"allocated_mb": mb,
+		"held_ms":      hold.Milliseconds(),
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCPUBurnsForTheRequestedTime(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	start := time.Now()
+	w := get(h, "/cpu?ms=100&workers=2")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("returned after %v, want at least 100ms", elapsed)
+	}
+	var body struct {
+		Workers int   `json:"workers"`
+		Hashes  int64 `json:"hashes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Workers != 2 || body.Hashes <= 0 {
+		t.Errorf("body = %+v, want 2 workers and some hashes", body)
+	}
+}
+
+func TestCPUStopsWhenCancelled(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	record(h, httptest.NewRequestWithContext(ctx, http.MethodGet, "/cpu?ms=10000", nil))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("kept burning for %v after cancellation", elapsed)
+	}
+}
+
+func TestMem(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxAllocMB = 8
+	h := newServer(cfg).routes()
+
+	var body map[string]int
+	if err := json.Unmarshal(get(h, "/mem?mb=4&hold_ms=0").Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["allocated_mb"] != 4 {
+		t.Errorf("allocated_mb = %d, want 4", body["allocated_mb"])
+	}
+	for _, mb := range []string{"9", "0", "x"} {
+		if w := get(h, "/mem?mb="+mb); w.Code != http.StatusBadRequest {
+			t.Errorf("mb=%s: status = %d, want 400", mb, w.Code)
+		}
+	}
+}
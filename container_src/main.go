@@ -1,84 +1,208 @@
 package main
 
 import (
-	"crypto/rand"
-	"fmt"
-	"log"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	message := os.Getenv("MESSAGE")
-	secret := os.Getenv("MYSECRET")
-	instanceId := os.Getenv("CLOUDFLARE_DEPLOYMENT_ID")
-	
-	// Test writing to persistent storage
-	counterFile := "/storage/visit_counter.txt"
-	counter := 1
-	
-	// Read existing counter
-	if data, err := os.ReadFile(counterFile); err == nil {
-		if count, err := strconv.Atoi(string(data)); err == nil {
-			counter = count + 1
+func main() {
+	// The level starts at info so problems loading the config are logged,
+	// then follows LOG_LEVEL, including when it is reloaded on SIGHUP.
+	logLevel := new(slog.LevelVar)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	live := newLiveConfig(cfg, logLevel)
+	if !cfg.DryRun {
+		if err := os.MkdirAll(cfg.StorageDir, cfg.StorageDirMode); err != nil {
+			slog.Warn("failed to create storage dir", "dir", cfg.StorageDir, "error", err)
 		}
 	}
-	
-	// Write new counter
-	os.WriteFile(counterFile, []byte(strconv.Itoa(counter)), 0644)
-	
-	messageToPrint := fmt.Sprintf("Hi, I'm a container! Message: \"%s\", Secret: \"%s\", Instance: %s, Visit: %d", 
-		message, secret, instanceId, counter)
-	fmt.Println(messageToPrint)
-	fmt.Fprint(w, messageToPrint)
-}
 
-func errorHandler(w http.ResponseWriter, r *http.Request) {
-	panic("This is a panic")
-}
+	app := newServer(cfg)
+	mux := app.routes()
 
-func randomDataHandler(w http.ResponseWriter, r *http.Request) {
-	sizeParam := r.URL.Query().Get("size")
-	size := 1024
-	if sizeParam != "" {
-		if parsedSize, err := strconv.Atoi(sizeParam); err == nil && parsedSize > 0 {
-			size = parsedSize
-		}
+	slog.Info("starting", "instance_uuid", instanceUUID, "config", cfg)
+
+	listeners, err := openListeners(cfg)
+	if err != nil {
+		slog.Error("failed to listen", "error", err)
+		os.Exit(1)
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// /admin/shutdown stops the server the same way a signal does.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-app.ShutdownRequested():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	chunkSize := 64 * 1024 // 64KB chunks
-	buffer := make([]byte, chunkSize)
-	flushCounter := 0
+	app.Start(ctx)
+	go watchReload(ctx, live)
+
+	var fallback http.Handler
+	if cfg.SPAFallback {
+		fallback = http.HandlerFunc(app.handleRoot)
+	}
+	var h http.Handler = recoverMiddleware(gzipMiddleware(jsonRouteErrors(mux, fallback), cfg.GzipLevel, cfg.BasePath+"/random", cfg.BasePath+"/stream"))
+	h = maxBodyBytesMiddleware(h, int64(cfg.MaxBodyBytes))
+	h = maxURLLengthMiddleware(h, cfg.MaxURLLength)
+	if cfg.ChaosMaxDelay > 0 {
+		h = chaosMiddleware(h, cfg.ChaosMinDelay, cfg.ChaosMaxDelay, mrand.New(mrand.NewPCG(mrand.Uint64(), mrand.Uint64())))
+	}
+	if cfg.RequestTimeout > 0 {
+		h = timeoutMiddleware(h, cfg.RequestTimeout, withBasePath(cfg.BasePath, cfg.RequestTimeoutExempt)...)
+	}
+	if cfg.MaxConcurrent > 0 {
+		h = concurrencyLimitMiddleware(h, cfg.MaxConcurrent, withBasePath(cfg.BasePath, probePaths)...)
+	}
+	if cfg.BasicAuthUser != "" {
+		h = basicAuthMiddleware(h, cfg.BasicAuthUser, cfg.BasicAuthPass, withBasePath(cfg.BasePath, cfg.BasicAuthPaths))
+	}
+	// Rate limits and extra headers can be reloaded, so they are always
+	// wired in and read the live config. The limiter sits outside Basic
+	// Auth so failed logins count against it too.
+	h = rateLimitMiddleware(h, live.RateLimiter)
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		h = corsMiddleware(h, cfg.CORSAllowedOrigins)
+	}
+	h = extraHeadersMiddleware(h, func() map[string]string { return live.Load().ExtraHeaders })
+	h = clientIPMiddleware(instanceUUIDMiddleware(requestIDMiddleware(loggingMiddleware(serverTimingMiddleware(metricsMiddleware(h))))), cfg.TrustProxyHeaders)
+
+	srv := newHTTPServer(cfg, h)
+	drain := func() {
+		app.Drain()
+		if cfg.PrestopDelay > 0 {
+			slog.Info("draining before shutdown", "delay", cfg.PrestopDelay.String())
+			time.Sleep(cfg.PrestopDelay)
+		}
+	}
+	err = serve(ctx, srv, cfg.ShutdownTimeout, drain, listeners...)
+	if cerr := app.Close(); cerr != nil {
+		slog.Error("failed to persist state", "error", cerr)
+	}
+	if err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+}
 
-	for remaining := size; remaining > 0; {
-		currentChunk := min(remaining, chunkSize)
+// newHTTPServer builds the server with the configured timeouts guarding
+// against slow clients. With ENABLE_H2C it also speaks cleartext HTTP/2 to
+// clients that start with the HTTP/2 preface; the Upgrade: h2c dance is not
+// supported.
+func newHTTPServer(cfg Config, h http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.EnableH2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
 
-		rand.Read(buffer[:currentChunk])
-		w.Write(buffer[:currentChunk])
-		remaining -= currentChunk
-		flushCounter++
+// listener is a socket the server accepts on. Listeners with a certificate
+// terminate TLS.
+type listener struct {
+	net.Listener
+	certFile, keyFile string
+}
 
-		// Flush every 16 chunks (1MB) instead of every chunk
-		if flushCounter%16 == 0 {
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
+// openListeners binds the plain HTTP port and, when TLS_CERT_FILE and
+// TLS_KEY_FILE are set, the TLS port. With TLS configured, plain HTTP is only
+// served if PORT is set explicitly.
+func openListeners(cfg Config) ([]listener, error) {
+	var listeners []listener
+	if cfg.HTTPEnabled {
+		ln, err := net.Listen("tcp", cfg.Addr())
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("listening", "addr", ln.Addr().String())
+		listeners = append(listeners, listener{Listener: ln})
+	}
+	if cfg.TLSEnabled() {
+		// Load the pair upfront so a bad certificate fails startup instead of
+		// the first handshake.
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", ":"+cfg.TLSPort)
+		if err != nil {
+			return nil, err
 		}
+		slog.Info("listening", "addr", ln.Addr().String(), "tls", true)
+		listeners = append(listeners, listener{Listener: ln, certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile})
 	}
+	return listeners, nil
+}
+
+// probePaths are the liveness and readiness endpoints, which must keep
+// answering however loaded the server is.
+var probePaths = []string{"/health", "/ready"}
 
-	// Final flush
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+// withBasePath prefixes each of paths with base.
+func withBasePath(base string, paths []string) []string {
+	prefixed := make([]string, len(paths))
+	for i, p := range paths {
+		prefixed[i] = base + p
 	}
+	return prefixed
 }
 
-func main() {
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/container", handler)
-	http.HandleFunc("/error", errorHandler)
-	http.HandleFunc("/random", randomDataHandler)
-	log.Fatal(http.ListenAndServe(":80", nil))
+// serve runs srv on every listener until ctx is cancelled, then calls drain,
+// which may keep serving for a while, and shuts srv down, giving in-flight
+// requests up to timeout to complete.
+func serve(ctx context.Context, srv *http.Server, timeout time.Duration, drain func(), listeners ...listener) error {
+	errc := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func() {
+			if ln.certFile != "" {
+				errc <- srv.ServeTLS(ln, ln.certFile, ln.keyFile)
+			} else {
+				errc <- srv.Serve(ln)
+			}
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	drain()
+
+	slog.Info("shutting down", "timeout", timeout.String(), "in_flight", metrics.Active())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	slog.Info("shutdown complete")
+	return nil
 }
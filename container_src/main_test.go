@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerListensOnPORT(t *testing.T) {
+	t.Setenv("PORT", "8081")
+	t.Setenv("STORAGE_DIR", t.TempDir())
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := openListeners(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("got %d listeners, want 1", len(listeners))
+	}
+	srv := newHTTPServer(cfg, newServer(cfg).routes())
+	go srv.Serve(listeners[0])
+	defer srv.Close()
+
+	resp, err := http.Get("http://127.0.0.1:8081/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("GET /health = %d %q, want 200 \"ok\"", resp.StatusCode, body)
+	}
+}
+
+func TestServeFinishesInFlightRequestsOnShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, srv, 5*time.Second, func() {}, listener{Listener: ln}) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		resc <- result{string(body), err}
+	}()
+
+	<-started
+	cancel()
+	if res := <-resc; res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request got %q, %v; want \"done\"", res.body, res.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() = %v, want nil", err)
+	}
+}
+
+func TestNewHTTPServerTimeouts(t *testing.T) {
+	t.Setenv("READ_HEADER_TIMEOUT", "2")
+	t.Setenv("READ_TIMEOUT", "3")
+	t.Setenv("WRITE_TIMEOUT", "4")
+	t.Setenv("IDLE_TIMEOUT", "5")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(cfg, http.NotFoundHandler())
+	for name, got := range map[string][2]time.Duration{
+		"ReadHeaderTimeout": {srv.ReadHeaderTimeout, 2 * time.Second},
+		"ReadTimeout":       {srv.ReadTimeout, 3 * time.Second},
+		"WriteTimeout":      {srv.WriteTimeout, 4 * time.Second},
+		"IdleTimeout":       {srv.IdleTimeout, 5 * time.Second},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s = %v, want %v", name, got[0], got[1])
+		}
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir
+// and returns their paths along with a pool trusting the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	cfg := testConfig(t)
+	var pool *x509.CertPool
+	cfg.TLSCertFile, cfg.TLSKeyFile, pool = writeSelfSignedCert(t, t.TempDir())
+	cfg.TLSPort = "0"
+	cfg.HTTPEnabled = false
+
+	listeners, err := openListeners(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].certFile == "" {
+		t.Fatalf("got %d listeners, want just the TLS one", len(listeners))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, newHTTPServer(cfg, newServer(cfg).routes()), time.Second, func() {}, listeners...)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/health", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("status = %d, TLS = %v; want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.EnableH2C = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(cfg, newServer(cfg).routes())
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	resp, err := (&http.Client{Transport: tr}).Get("http://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", resp.Proto)
+	}
+}
+
+func TestReadyFailsWhileDraining(t *testing.T) {
+	cfg := testConfig(t)
+	app := newServer(cfg)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String() + "/ready"
+	// Without keep-alives no idle or unused connection is left for
+	// Shutdown to wait on.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var status int
+	drain := func() {
+		// Still serving: the platform sees /ready fail before the
+		// listener goes away.
+		app.Drain()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Errorf("GET /ready while draining: %v", err)
+			return
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newHTTPServer(cfg, app.routes()), time.Second, drain, listener{Listener: ln})
+	}()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /ready before shutdown = %d, want 200", resp.StatusCode)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("GET /ready while draining = %d, want 503", status)
+	}
+}
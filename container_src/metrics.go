@@ -0,0 +1,147 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram. They match the Prometheus client defaults.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestMetrics is a minimal Prometheus-compatible registry holding the
+// request counter and duration histogram, so the image needs no client
+// library.
+type requestMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+
+	// active and served count requests as they start and finish, without
+	// the lock, so draining can be watched while requests are in flight.
+	active atomic.Int64
+	served atomic.Uint64
+}
+
+type requestKey struct {
+	path   string
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// metrics is the process-wide registry served at /metrics.
+var metrics = newRequestMetrics()
+
+func (m *requestMetrics) observe(path string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{path, status}]++
+
+	h, ok := m.durations[path]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[path] = h
+	}
+	secs := d.Seconds()
+	if i, _ := slices.BinarySearch(durationBuckets, secs); i < len(durationBuckets) {
+		h.counts[i]++
+	}
+	h.sum += secs
+	h.count++
+}
+
+// Active returns the number of requests currently being served.
+func (m *requestMetrics) Active() int64 { return m.active.Load() }
+
+// Served returns the number of requests completed since boot.
+func (m *requestMetrics) Served() uint64 { return m.served.Load() }
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *requestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintln(w, "# HELP http_requests_in_flight HTTP requests currently being served.")
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(w, "http_requests_in_flight %d\n", m.Active())
+	fmt.Fprintln(w, "# HELP http_requests_served_total HTTP requests completed since boot.")
+	fmt.Fprintln(w, "# TYPE http_requests_served_total counter")
+	fmt.Fprintf(w, "http_requests_served_total %d\n", m.Served())
+
+	fmt.Fprintln(w, "# HELP http_requests_total Total HTTP requests by path and status.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		return cmp.Or(cmp.Compare(a.path, b.path), cmp.Compare(a.status, b.status))
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total{path=%q,status=\"%d\"} %d\n", k.path, k.status, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP request duration by path.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	paths := make([]string, 0, len(m.durations))
+	for p := range m.durations {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		h := m.durations[p]
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{path=%q,le=%q} %d\n",
+				p, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{path=%q,le=\"+Inf\"} %d\n", p, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{path=%q} %g\n", p, h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{path=%q} %d\n", p, h.count)
+	}
+}
+
+// metricsMiddleware records every request in the metrics registry. The mux
+// pattern is used as the path label so unknown URLs can't blow up the label
+// cardinality. The in-flight gauge counts the scrape itself, and a request
+// that panics still leaves it.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.active.Add(1)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		// Deferred so aborted requests are counted as well.
+		defer func() {
+			path := r.Pattern
+			if path == "" {
+				path = "unmatched"
+			}
+			metrics.observe(path, rec.Status(), time.Since(start))
+			metrics.active.Add(-1)
+			metrics.served.Add(1)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricValue returns the value of the series named exactly series in a
+// /metrics body, or 0 if it isn't there. metrics is process-wide, so tests
+// compare values before and after rather than expecting absolute counts.
+func metricValue(t *testing.T, h http.Handler, series string) float64 {
+	t.Helper()
+	for line := range strings.Lines(get(h, "/metrics").Body.String()) {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), series+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("series %s: %v", series, err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountsRequests(t *testing.T) {
+	h := metricsMiddleware(newServer(testConfig(t)).routes())
+	const series = `http_requests_total{path="GET /{$}",status="200"}`
+
+	before := metricValue(t, h, series)
+	get(h, "/")
+	if after := metricValue(t, h, series); after != before+1 {
+		t.Errorf("%s went from %v to %v, want +1", series, before, after)
+	}
+}
+
+func TestMetricsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	h := metricsMiddleware(newServer(testConfig(t)).routes())
+
+	active, served := metricValue(t, h, "http_requests_in_flight"), metricValue(t, h, "http_requests_served_total")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get(slow, "/slow")
+	}()
+	<-started
+	// Scraping /metrics counts as in flight and served too, hence the +1s.
+	if got := metricValue(t, h, "http_requests_in_flight"); got != active+1 {
+		t.Errorf("in flight during the slow request = %v, want %v", got, active+1)
+	}
+	close(release)
+	<-done
+	if got := metricValue(t, h, "http_requests_served_total"); got != served+3 {
+		t.Errorf("served = %v, want %v", got, served+3)
+	}
+}
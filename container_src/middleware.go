@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	mrand "math/rand/v2"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recoverMiddleware turns a panicking handler into a 500 response instead of
+// letting net/http tear down the connection. If the handler had already
+// started its response the status can't be changed, so after logging the
+// request is aborted to make the truncation visible to the client rather
+// than appending an error to a partial body.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			slog.Error("panic serving request", "request_id", RequestIDFromContext(r.Context()),
+				"method", r.Method, "path", r.URL.Path, "response_started", rec.status != 0,
+				"panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// gzipMiddleware compresses responses at level for clients that accept gzip.
+// Requests for skipPaths, like /random whose high-entropy body would only
+// grow, are passed through untouched.
+func gzipMiddleware(next http.Handler, level int, skipPaths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(skipPaths, r.URL.Path) || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w, level: level}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip without
+// a zero quality value.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body once the handler commits to a
+// status that carries one.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level       int
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	if code != http.StatusNoContent && code != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		// The compressed bytes differ from what a strong tag vouches for.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		// The level was validated at startup, so this can't fail.
+		g.gz, _ = gzip.NewWriterLevel(g.ResponseWriter, g.level)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Close flushes the gzip footer, if compression was started.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// concurrencyLimitMiddleware caps the number of requests served at once,
+// shedding the excess with 503 rather than queueing it. Requests for
+// skipPaths, like the health probes, neither take a slot nor get shed, so a
+// busy instance isn't restarted for being busy.
+func concurrencyLimitMiddleware(next http.Handler, limit int, skipPaths ...string) http.Handler {
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(skipPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxBodyBytesMiddleware caps request bodies at limit bytes. Requests that
+// declare a larger Content-Length are rejected with 413 upfront; for the
+// rest, reads past the limit fail with *http.MaxBytesError, which handlers
+// should answer with 413 too.
+func maxBodyBytesMiddleware(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeoutMiddleware answers 503 once a request has run for timeout, as
+// http.TimeoutHandler does, and cancels its context so handlers that honour
+// it stop; one that doesn't finishes in the background, its output
+// discarded. Responses are buffered until the handler returns, so the 503
+// can still replace them. Requests for skipPaths, like /stream which is long
+// and streamed by design, are neither buffered nor timed out.
+func timeoutMiddleware(next http.Handler, timeout time.Duration, skipPaths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(skipPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		tr := r.WithContext(ctx)
+		tw := &timeoutWriter{header: make(http.Header), req: tr}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, tr)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			// The mux records the matched pattern on the copy it was
+			// given; hand it back so metricsMiddleware, outside, can label
+			// by route.
+			r.Pattern = tr.Pattern
+			maps.Copy(w.Header(), tw.header)
+			w.WriteHeader(cmp.Or(tw.status, http.StatusOK))
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			// Reading tr.Pattern here would race with the mux setting it,
+			// so only a pattern seen by the handler's first write is known.
+			r.Pattern = tw.pattern
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				slog.Warn("request timed out", "request_id", RequestIDFromContext(r.Context()),
+					"path", r.URL.Path, "timeout", timeout.String())
+				writeJSONError(w, http.StatusServiceUnavailable, "request timed out")
+			}
+		}
+	})
+}
+
+// timeoutWriter buffers a response for timeoutMiddleware. Once the request
+// has timed out, writes fail with http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	header http.Header
+	req    *http.Request
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	status   int
+	pattern  string
+	timedOut bool
+}
+
+func (t *timeoutWriter) Header() http.Header { return t.header }
+
+func (t *timeoutWriter) WriteHeader(code int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeHeaderLocked(code)
+}
+
+// writeHeaderLocked records code as the status unless one was already. As
+// the response is held back, informational statuses can't be sent early and
+// are dropped.
+func (t *timeoutWriter) writeHeaderLocked(code int) {
+	if t.timedOut || t.status != 0 || code < 200 {
+		return
+	}
+	t.status = code
+	// Called from the handler's goroutine, after the mux set the pattern.
+	t.pattern = t.req.Pattern
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	t.writeHeaderLocked(http.StatusOK)
+	return t.buf.Write(b)
+}
+
+// maxURLLengthMiddleware rejects requests whose target, the path and query
+// as sent, is longer than limit bytes with 414.
+func maxURLLengthMiddleware(next http.Handler, limit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > limit {
+			writeJSONError(w, http.StatusRequestURITooLong, http.StatusText(http.StatusRequestURITooLong))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chaosMiddleware delays every request by a random duration in
+// [minDelay, maxDelay], drawn from rng, before handling it, to exercise
+// callers' timeouts. A seeded rng makes the delays reproducible.
+func chaosMiddleware(next http.Handler, minDelay, maxDelay time.Duration, rng *mrand.Rand) http.Handler {
+	var mu sync.Mutex // rng isn't safe for concurrent use
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := minDelay
+		if maxDelay > minDelay {
+			mu.Lock()
+			d += time.Duration(rng.Int64N(int64(maxDelay - minDelay + 1)))
+			mu.Unlock()
+		}
+		slog.Debug("chaos delay", "request_id", RequestIDFromContext(r.Context()), "delay", d.String())
+		if !sleepUntil(r.Context(), time.Now().Add(d)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cfTraceHeaders are Cloudflare request headers added to the access log when
+// present, under the given attribute names.
+var cfTraceHeaders = []struct{ header, attr string }{
+	{"CF-Ray", "cf_ray"},
+	{"CF-Worker", "cf_worker"},
+}
+
+// loggingMiddleware emits one access log line per request. CF-Ray is echoed
+// back so a response can be matched to Cloudflare's own logs.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if ray := r.Header.Get("CF-Ray"); ray != "" {
+			w.Header().Set("CF-Ray", ray)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		// Deferred so requests aborted with http.ErrAbortHandler, such as a
+		// late panic, are logged too.
+		defer func() {
+			attrs := []any{"request_id", RequestIDFromContext(r.Context()),
+				"client_ip", ClientIP(r), "method", r.Method, "path", r.URL.Path, "status", rec.Status(),
+				"bytes", rec.bytes, "duration_ms", float64(time.Since(start).Microseconds()) / 1000}
+			for _, h := range cfTraceHeaders {
+				if v := r.Header.Get(h.header); v != "" {
+					attrs = append(attrs, h.attr, v)
+				}
+			}
+			slog.Info("request", attrs...)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// serverTimingMiddleware reports the handler's processing time to the
+// client as "Server-Timing: app;dur=<ms>". Headers can't follow the body, so
+// the duration is measured up to when the response starts: for streamed
+// responses that is the time to the first byte, not to the last.
+func serverTimingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &timingWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(tw, r)
+		if !tw.wroteHeader {
+			// An empty 200 is sent once the handler returns.
+			tw.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// timingWriter adds the Server-Timing header as the response starts.
+type timingWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func (t *timingWriter) WriteHeader(code int) {
+	// Informational responses go out ahead of the real one, which is still
+	// to be timed.
+	if !t.wroteHeader && code >= 200 {
+		t.wroteHeader = true
+		dur := float64(time.Since(t.start).Microseconds()) / 1000
+		t.Header().Add("Server-Timing", "app;dur="+strconv.FormatFloat(dur, 'f', 3, 64))
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *timingWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *timingWriter) Flush() {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+func (t *timingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// statusRecorder captures the status code and body size written by the
+// wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	// Informational responses precede the status that gets recorded.
+	if s.status == 0 && code >= 200 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Status returns the status sent to the client, defaulting to 200 when the
+// handler never wrote anything.
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	clientIPKey
+)
+
+// extraHeadersMiddleware sets the configured EXTRA_HEADERS, as currently
+// returned by headers, on every response. Handlers run afterwards, so they
+// can still override them.
+func extraHeadersMiddleware(next http.Handler, headers func() map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers() {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instanceUUIDMiddleware stamps every response with X-Instance-UUID so
+// clients can tell which process, and which restart of it, answered.
+func instanceUUIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Instance-UUID", instanceUUID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDMiddleware tags each request with the caller's X-Request-ID, or a
+// fresh random one, and echoes it back so both sides can correlate logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// RequestIDFromContext returns the request ID set by requestIDMiddleware, or
+// "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts short IDs made of URL-safe characters, so a client
+// can't smuggle arbitrary text into our logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverMiddlewareAnswers500(t *testing.T) {
+	h := recoverMiddleware(newServer(testConfig(t)).routes())
+
+	w := get(h, "/error")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", w.Body, err)
+	}
+	if body["error"] != http.StatusText(http.StatusInternalServerError) {
+		t.Errorf("error = %q, want the generic status text", body["error"])
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	cfg := testConfig(t)
+	h := gzipMiddleware(newServer(cfg).routes(), cfg.GzipLevel, "/random")
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := record(h, r)
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", ce)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(body), "Hi, I'm a container!") {
+		t.Errorf("decompressed body = %q", body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/random?size=100", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	if w := record(h, r); w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 100 {
+		t.Errorf("/random was compressed: Content-Encoding %q, %d bytes", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	w := record(h, r)
+	if got := w.Header().Get("X-Request-ID"); got != "abc-123" || seen != "abc-123" {
+		t.Errorf("passthrough: header %q, context %q; want abc-123", got, seen)
+	}
+
+	w = get(h, "/")
+	got := w.Header().Get("X-Request-ID")
+	if len(got) != 32 || got != seen {
+		t.Errorf("generated: header %q, context %q; want the same 32 hex chars", got, seen)
+	}
+	if get(h, "/").Header().Get("X-Request-ID") == got {
+		t.Error("generated IDs repeat")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	logs := captureLogs(t)
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}))
+	get(h, "/pot")
+
+	entry := findLog(t, logs, "request")
+	if entry["status"] != float64(http.StatusTeapot) || entry["path"] != "/pot" || entry["bytes"] != 15.0 {
+		t.Errorf("access log = %v, want status 418, path /pot, 15 bytes", entry)
+	}
+	if d, _ := entry["duration_ms"].(float64); d <= 0 {
+		t.Errorf("duration_ms = %v, want > 0", entry["duration_ms"])
+	}
+}
+
+func TestRecoverMiddlewareAfterResponseStarted(t *testing.T) {
+	logs := captureLogs(t)
+	srv := httptest.NewServer(recoverMiddleware(newServer(testConfig(t)).routes()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/slowpanic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "working...\n" || err == nil {
+		t.Errorf("got %d %q, %v; want the partial 200 body cut off with an error", resp.StatusCode, body, err)
+	}
+
+	resp, err = http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatalf("server gone after the panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /health after the panic = %d", resp.StatusCode)
+	}
+
+	// The client can see the abort before the log is written; Close waits
+	// for the handler.
+	srv.Close()
+	if entry := findLog(t, logs, "panic serving request"); entry["response_started"] != true {
+		t.Errorf("panic log = %v, want response_started", entry)
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := concurrencyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-release
+		}
+	}), 1)
+
+	done := make(chan int)
+	go func() { done <- get(h, "/slow").Code }()
+	<-entered
+
+	w := get(h, "/fast")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request = %d with Retry-After %q, want 503 and 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("slow request = %d, want 200", code)
+	}
+	if w := get(h, "/fast"); w.Code != http.StatusOK {
+		t.Errorf("after the slot freed up: %d, want 200", w.Code)
+	}
+}
+
+func TestMaxBodyBytesMiddleware(t *testing.T) {
+	h := maxBodyBytesMiddleware(newServer(testConfig(t)).routes(), 16)
+	body := strings.Repeat("x", 17)
+
+	// Declared too large: rejected before the handler runs.
+	if w := record(h, httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared length: status = %d, want 413", w.Code)
+	}
+
+	// Unknown length: the read fails partway.
+	r := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body))
+	r.ContentLength = -1
+	if w := record(h, r); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("streamed body: status = %d, want 413", w.Code)
+	}
+
+	if w := record(h, httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body[:16]))); w.Code != http.StatusOK {
+		t.Errorf("body at the limit: status = %d, want 200", w.Code)
+	}
+}
+
+func TestInstanceUUIDHeader(t *testing.T) {
+	h := instanceUUIDMiddleware(newServer(testConfig(t)).routes())
+	first := get(h, "/health").Header().Get("X-Instance-UUID")
+	if first != instanceUUID || len(first) != 36 {
+		t.Fatalf("X-Instance-UUID = %q, want the 36-char process UUID", first)
+	}
+	if second := get(h, "/").Header().Get("X-Instance-UUID"); second != first {
+		t.Errorf("UUID changed within the process: %q then %q", first, second)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/health", nil)
+	r.Header.Set("Accept", "application/json")
+	var health map[string]any
+	json.Unmarshal(record(h, r).Body.Bytes(), &health)
+	if health["instance_uuid"] != instanceUUID {
+		t.Errorf("/health instance_uuid = %v, want %q", health["instance_uuid"], instanceUUID)
+	}
+}
+
+func TestChaosMiddlewareSeededDelays(t *testing.T) {
+	logs := captureLogs(t)
+	const minDelay, maxDelay = 10 * time.Millisecond, 30 * time.Millisecond
+	h := chaosMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		minDelay, maxDelay, mrand.New(mrand.NewPCG(1, 2)))
+
+	// The same seed gives the same sequence of delays.
+	want := mrand.New(mrand.NewPCG(1, 2))
+	const requests = 5
+	for range requests {
+		start := time.Now()
+		get(h, "/")
+		if elapsed := time.Since(start); elapsed < minDelay {
+			t.Errorf("request took %v, want at least %v", elapsed, minDelay)
+		}
+	}
+	delays := 0
+	for line := range strings.Lines(logs.String()) {
+		var entry struct{ Msg, Delay string }
+		json.Unmarshal([]byte(line), &entry)
+		if entry.Msg != "chaos delay" {
+			continue
+		}
+		delays++
+		expected := minDelay + time.Duration(want.Int64N(int64(maxDelay-minDelay+1)))
+		if entry.Delay != expected.String() {
+			t.Errorf("delay %d = %s, want %s", delays, entry.Delay, expected)
+		}
+	}
+	if delays != requests {
+		t.Errorf("logged %d delays, want %d", delays, requests)
+	}
+}
+
+func TestLoggingMiddlewareCloudflareHeaders(t *testing.T) {
+	logs := captureLogs(t)
+	h := loggingMiddleware(http.NotFoundHandler())
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("CF-Ray", "8a1b2c3d4e5f-SJC")
+	w := record(h, r)
+	if got := w.Header().Get("CF-Ray"); got != "8a1b2c3d4e5f-SJC" {
+		t.Errorf("CF-Ray echoed as %q", got)
+	}
+	entry := findLog(t, logs, "request")
+	if entry["cf_ray"] != "8a1b2c3d4e5f-SJC" {
+		t.Errorf("cf_ray = %v", entry["cf_ray"])
+	}
+	if _, ok := entry["cf_worker"]; ok {
+		t.Error("absent CF-Worker logged")
+	}
+}
+
+func TestExtraHeaders(t *testing.T) {
+	headers := parseExtraHeaders("X-Foo: bar, x-baz: qux, malformed, Bad Name: v")
+	if len(headers) != 2 || headers["X-Foo"] != "bar" || headers["X-Baz"] != "qux" {
+		t.Fatalf("parseExtraHeaders = %v, want X-Foo and X-Baz only", headers)
+	}
+
+	h := extraHeadersMiddleware(newServer(testConfig(t)).routes(), func() map[string]string { return headers })
+	w := get(h, "/health")
+	if got := w.Header().Get("X-Foo"); got != "bar" {
+		t.Errorf("X-Foo = %q, want bar", got)
+	}
+	if got := w.Header().Get("X-Baz"); got != "qux" {
+		t.Errorf("X-Baz = %q, want qux", got)
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	body := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 200))
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(body) })
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		var want bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&want, level)
+		zw.Write(body)
+		zw.Close()
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := record(gzipMiddleware(h, level), r)
+		if !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+			t.Errorf("level %d: response isn't compressed at that level", level)
+		}
+	}
+}
+
+func TestStatusRecorderSkipsInformational(t *testing.T) {
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.WriteHeader(http.StatusEarlyHints)
+	rec.WriteHeader(http.StatusCreated)
+	if rec.status != http.StatusCreated {
+		t.Errorf("status = %d, want 201", rec.status)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	mux := newServer(testConfig(t)).routes()
+	h := timeoutMiddleware(mux, 50*time.Millisecond, "/stream")
+
+	w := get(h, "/sleep?ms=1000")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	if body := decodeError(t, w); body["error"] != "request timed out" {
+		t.Errorf("body = %v", body)
+	}
+	if w := get(h, "/sleep?ms=1"); w.Code != http.StatusOK {
+		t.Errorf("fast request: status = %d, want 200", w.Code)
+	}
+}
+
+func TestTimeoutMiddlewareExemptPaths(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			t.Error("exempt request was timed out")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+	if w := get(timeoutMiddleware(slow, 10*time.Millisecond, "/stream"), "/stream"); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", w.Code)
+	}
+}
+
+func TestTimeoutMiddlewareKeepsRoutePattern(t *testing.T) {
+	h := metricsMiddleware(timeoutMiddleware(newServer(testConfig(t)).routes(), time.Second))
+	const series = `http_requests_total{path="GET /{$}",status="200"}`
+
+	before := metricValue(t, h, series)
+	get(h, "/")
+	if after := metricValue(t, h, series); after != before+1 {
+		t.Errorf("%s went from %v to %v, want +1", series, before, after)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	h := serverTimingMiddleware(newServer(testConfig(t)).routes())
+	w := get(h, "/sleep?ms=20")
+	v, ok := strings.CutPrefix(w.Header().Get("Server-Timing"), "app;dur=")
+	if !ok {
+		t.Fatalf("Server-Timing = %q, want app;dur=<ms>", w.Header().Get("Server-Timing"))
+	}
+	dur, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dur < 20 {
+		t.Errorf("dur = %vms, want at least the 20ms the handler slept", dur)
+	}
+
+	// A handler that never writes still gets the header.
+	empty := serverTimingMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	if w := get(empty, "/"); !strings.HasPrefix(w.Header().Get("Server-Timing"), "app;dur=") {
+		t.Errorf("empty response: Server-Timing = %q", w.Header().Get("Server-Timing"))
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	h := maxURLLengthMiddleware(newServer(testConfig(t)).routes(), 64)
+	w := get(h, "/?pad="+strings.Repeat("x", 64))
+	if w.Code != http.StatusRequestURITooLong {
+		t.Fatalf("status = %d, want 414", w.Code)
+	}
+	if body := decodeError(t, w); body["error"] != "Request URI Too Long" {
+		t.Errorf("body = %v", body)
+	}
+	if w := get(h, "/health"); w.Code != http.StatusOK {
+		t.Errorf("short URL: status = %d, want 200", w.Code)
+	}
+}
+
+func TestRecoverLogsPanicMessage(t *testing.T) {
+	h := recoverMiddleware(newServer(testConfig(t)).routes())
+	for target, want := range map[string]string{
+		"/error":                                 "This is a panic",
+		"/error?msg=disk+on+fire":                "disk on fire",
+		"/error?msg=line%0Abreak":                "line break",
+		"/error?msg=" + strings.Repeat("x", 300): strings.Repeat("x", maxPanicMessage),
+	} {
+		logs := captureLogs(t)
+		if w := get(h, target); w.Code != http.StatusInternalServerError {
+			t.Errorf("GET %s: status = %d, want 500", target, w.Code)
+		}
+		if got := findLog(t, logs, "panic serving request")["panic"]; got != want {
+			t.Errorf("GET %s: logged panic %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestLatePanicIsLoggedAndCounted(t *testing.T) {
+	logs := captureLogs(t)
+	h := loggingMiddleware(metricsMiddleware(recoverMiddleware(newServer(testConfig(t)).routes())))
+	const series = `http_requests_total{path="GET /slowpanic",status="200"}`
+	before := metricValue(t, h, series)
+
+	srv := httptest.NewServer(h)
+	resp, err := http.Get(srv.URL + "/slowpanic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	srv.Close()
+
+	if after := metricValue(t, h, series); after != before+1 {
+		t.Errorf("%s went from %v to %v, want +1", series, before, after)
+	}
+	for line := range strings.Lines(logs.String()) {
+		var entry map[string]any
+		json.Unmarshal([]byte(line), &entry)
+		if entry["msg"] == "request" && entry["path"] == "/slowpanic" {
+			return
+		}
+	}
+	t.Errorf("no access log for the aborted request in %q", logs)
+}
+
+func TestConcurrencyLimitSkipsProbes(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := concurrencyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-release
+		}
+	}), 1, probePaths...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get(h, "/slow")
+	}()
+	<-entered
+	for _, target := range probePaths {
+		if w := get(h, target); w.Code != http.StatusOK {
+			t.Errorf("GET %s while saturated = %d, want 200", target, w.Code)
+		}
+	}
+	if w := get(h, "/fast"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /fast while saturated = %d, want 503", w.Code)
+	}
+	close(release)
+	<-done
+}
+
+func TestTimeoutMiddlewareIgnoredContext(t *testing.T) {
+	finished := make(chan struct{})
+	stubborn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+		time.Sleep(300 * time.Millisecond)
+		if _, err := w.Write([]byte("late")); err != http.ErrHandlerTimeout {
+			t.Errorf("late write: err = %v, want http.ErrHandlerTimeout", err)
+		}
+	})
+	h := timeoutMiddleware(stubborn, 50*time.Millisecond)
+
+	start := time.Now()
+	w := get(h, "/")
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("503 sent after %v, want it at the 50ms deadline", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	if body := decodeError(t, w); body["error"] != "request timed out" {
+		t.Errorf("body = %v", body)
+	}
+	<-finished
+}
+
+func TestTimeoutMiddlewarePassesResponseThrough(t *testing.T) {
+	h := timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("made"))
+	}), time.Second)
+	w := get(h, "/")
+	if w.Code != http.StatusCreated || w.Header().Get("X-Test") != "yes" || w.Body.String() != "made" {
+		t.Errorf("got %d %q with X-Test %q, want the handler's 201", w.Code, w.Body, w.Header().Get("X-Test"))
+	}
+}
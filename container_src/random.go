@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	mrand "math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxRandomSize caps /random at 100MB unless MAX_RANDOM_SIZE says
+// otherwise.
+const defaultMaxRandomSize = 100 << 20
+
+// maxRandomParts caps ?parts=, the number of bodies in a multipart response.
+const maxRandomParts = 16
+
+// randomContentTypes are the values ?type= may set Content-Type to.
+var randomContentTypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/json":         true,
+	"application/pdf":          true,
+	"application/zip":          true,
+	"image/jpeg":               true,
+	"image/png":                true,
+	"text/html":                true,
+	"text/plain":               true,
+	"video/mp4":                true,
+}
+
+// handleRandom streams ?size= random bytes. With ?checksum=1 it also
+// reports the SHA-256 of the body in X-Content-SHA256: seeded responses carry
+// it as a regular header, computed upfront from the deterministic stream,
+// while crypto/rand responses announce it as a trailer sent after the body.
+// With ?stats=1 the byte count and generation time are sent as the
+// X-Generated-Bytes and X-Duration-Ms trailers; they are logged either way.
+// Trailers need chunked encoding on HTTP/1.1, so those paths drop
+// Content-Length.
+func (s *Server) handleRandom(w http.ResponseWriter, r *http.Request) {
+	sizeParam := r.URL.Query().Get("size")
+	size := 1024
+	if sizeParam != "" {
+		parsedSize, err := strconv.Atoi(sizeParam)
+		if err != nil || parsedSize <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "size must be a positive integer")
+			return
+		}
+		size = parsedSize
+	}
+	if maxSize := s.cfg.MaxRandomSize; size > maxSize {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("size %d exceeds the maximum of %d bytes", size, maxSize))
+		return
+	}
+
+	// A seed switches to a deterministic math/rand stream so the same seed
+	// and size always produce the same bytes.
+	var seed int64
+	seeded := false
+	if seedParam := r.URL.Query().Get("seed"); seedParam != "" {
+		var err error
+		seed, err = strconv.ParseInt(seedParam, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "seed must be an integer")
+			return
+		}
+		seeded = true
+	}
+
+	// A rate throttles the body to that many bytes per second, to simulate a
+	// slow link. Note WRITE_TIMEOUT still bounds the whole response.
+	rate := 0
+	if rateParam := r.URL.Query().Get("rate"); rateParam != "" {
+		var err error
+		rate, err = strconv.Atoi(rateParam)
+		if err != nil || rate <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "rate must be a positive integer")
+			return
+		}
+	}
+
+	// The body is random whatever it claims to be; ?type= only changes the
+	// label, to see how downstream handles different media types.
+	contentType := "application/octet-stream"
+	if typeParam := r.URL.Query().Get("type"); typeParam != "" {
+		if !randomContentTypes[typeParam] {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unsupported type %q", typeParam))
+			return
+		}
+		contentType = typeParam
+	}
+
+	// ?parts=N sends N bodies of size bytes each in one multipart/mixed
+	// response, for exercising multipart handling downstream.
+	if partsParam := r.URL.Query().Get("parts"); partsParam != "" {
+		parts, err := strconv.Atoi(partsParam)
+		if err != nil || parts <= 0 || parts > maxRandomParts {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("parts must be an integer between 1 and %d", maxRandomParts))
+			return
+		}
+		if maxSize := s.cfg.MaxRandomSize; parts*size > maxSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%d parts of %d bytes exceed the maximum of %d bytes", parts, size, maxSize))
+			return
+		}
+		var src io.Reader = rand.Reader
+		if seeded {
+			src = seededReader(seed, 0)
+		}
+		s.writeRandomParts(w, r, randomStream{
+			src:        src,
+			chunkSize:  s.cfg.RandomChunkSize,
+			flushEvery: s.cfg.RandomFlushEvery,
+			rate:       rate,
+		}, parts, size, contentType)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// Only the requested range is generated; the bytes are random anyway, so
+	// there is nothing to seek past.
+	status, start, length := http.StatusOK, 0, size
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		first, end, err := parseRange(rangeHeader, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeJSONError(w, http.StatusRequestedRangeNotSatisfiable, err.Error())
+			return
+		}
+		status, start, length = http.StatusPartialContent, first, end-first+1
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	// The size is known upfront, so advertise it rather than falling back to
+	// chunked encoding; the flushes below still stream the body.
+	w.Header().Set("Content-Length", strconv.Itoa(length))
+
+	// HEAD gets the same headers so clients can discover the size, but no
+	// body is generated.
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	var src io.Reader = rand.Reader
+	if seeded {
+		src = seededReader(seed, start)
+	}
+
+	var hasher hash.Hash
+	if r.URL.Query().Get("checksum") == "1" {
+		if seeded {
+			h := sha256.New()
+			io.CopyN(h, seededReader(seed, start), int64(length))
+			w.Header().Set("X-Content-SHA256", hex.EncodeToString(h.Sum(nil)))
+		} else {
+			hasher = sha256.New()
+			w.Header().Del("Content-Length")
+			w.Header().Add("Trailer", "X-Content-SHA256")
+		}
+	}
+	stats := r.URL.Query().Get("stats") == "1"
+	if stats {
+		w.Header().Del("Content-Length")
+		w.Header().Add("Trailer", "X-Generated-Bytes")
+		w.Header().Add("Trailer", "X-Duration-Ms")
+	}
+	w.WriteHeader(status)
+
+	var out io.Writer = w
+	if hasher != nil {
+		out = io.MultiWriter(w, hasher)
+	}
+
+	ctx := r.Context()
+	// ?flush= picks how eagerly the body is pushed out: "chunk" flushes
+	// every chunk, "end" once after the last one and "none" leaves it to
+	// net/http's buffering. Anything else keeps the default of every
+	// RandomFlushEvery chunks.
+	flushEvery := s.cfg.RandomFlushEvery
+	flushMode := r.URL.Query().Get("flush")
+	switch flushMode {
+	case "chunk":
+		flushEvery = 1
+	case "end":
+		flushEvery = 0
+	case "none", "":
+	default:
+		s.logger.Debug("ignoring invalid flush mode", "request_id", RequestIDFromContext(ctx), "flush", flushMode)
+	}
+	var flush func(int)
+	if f, ok := w.(http.Flusher); ok && flushMode != "none" {
+		flush = func(written int) {
+			f.Flush()
+			s.logger.Debug("random flush", "request_id", RequestIDFromContext(ctx), "written", written, "size", length)
+		}
+	}
+	started := time.Now()
+	written, err := generateRandom(out, length, s.cfg.RandomChunkSize, flushEvery, func(rs *randomStream) {
+		rs.ctx, rs.src, rs.rate, rs.flush = ctx, src, rate, flush
+	})
+	if err != nil {
+		// Stop generating once the client has gone away or the
+		// connection broke; nothing more can be sent either way.
+		s.logger.Info("random stream truncated",
+			"request_id", RequestIDFromContext(ctx), "written", written, "size", length, "error", err)
+		return
+	}
+	elapsed := max(time.Since(started), time.Microsecond)
+	durationMs := float64(elapsed.Microseconds()) / 1000
+	s.logger.Info("random stream complete", "request_id", RequestIDFromContext(ctx),
+		"bytes", written, "duration_ms", durationMs, "bytes_per_sec", int64(float64(written)/elapsed.Seconds()))
+	if stats {
+		w.Header().Set("X-Generated-Bytes", strconv.Itoa(written))
+		w.Header().Set("X-Duration-Ms", strconv.FormatFloat(durationMs, 'f', 3, 64))
+	}
+
+	if hasher != nil {
+		w.Header().Set("X-Content-SHA256", hex.EncodeToString(hasher.Sum(nil)))
+	}
+}
+
+// writeRandomParts answers with a multipart/mixed body of parts random
+// bodies, each size bytes of contentType, drawn in turn from stream's source
+// so a seeded response stays deterministic. Range and ?checksum= apply only
+// to single bodies and are ignored here.
+func (s *Server) writeRandomParts(w http.ResponseWriter, r *http.Request, stream randomStream, parts, size int, contentType string) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	ctx := r.Context()
+	stream.ctx = ctx
+	if f, ok := w.(http.Flusher); ok {
+		stream.flush = func(int) { f.Flush() }
+	}
+	written := 0
+	for i := range parts {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {contentType},
+			"Content-Length":      {strconv.Itoa(size)},
+			"Content-Disposition": {fmt.Sprintf(`attachment; filename="random-%d"`, i+1)},
+		})
+		if err == nil {
+			var n int
+			n, err = stream.copy(part, size)
+			written += n
+		}
+		if err != nil {
+			s.logger.Info("random stream truncated",
+				"request_id", RequestIDFromContext(ctx), "part", i+1, "written", written, "size", parts*size, "error", err)
+			return
+		}
+	}
+	mw.Close()
+}
+
+// generateRandom writes size bytes from crypto/rand to w in chunkSize
+// pieces, flushing every flushEvery chunks and at the end if w is an
+// http.Flusher. It is /random's generation loop without the HTTP handling;
+// the handler uses opts to seed, throttle and cancel the stream. It returns
+// the number of bytes written and the error that stopped it early, if any.
+func generateRandom(w io.Writer, size, chunkSize, flushEvery int, opts ...func(*randomStream)) (int, error) {
+	stream := randomStream{ctx: context.Background(), src: rand.Reader, chunkSize: chunkSize, flushEvery: flushEvery}
+	if f, ok := w.(http.Flusher); ok {
+		stream.flush = func(int) { f.Flush() }
+	}
+	for _, opt := range opts {
+		opt(&stream)
+	}
+	return stream.copy(w, size)
+}
+
+// randomStream copies bytes from src in chunks, optionally throttled.
+type randomStream struct {
+	// ctx stops the stream early once done.
+	ctx        context.Context
+	src        io.Reader
+	chunkSize  int
+	flushEvery int // 0 flushes only at the end
+	// rate limits the stream to that many bytes per second when positive.
+	rate int
+	// flush, if set, is called with the byte count so far every flushEvery
+	// chunks and once at the end.
+	flush func(written int)
+}
+
+// copy writes size bytes to w. It stops early with ctx's error once ctx is
+// done, or with the first read or write error, typically a client that went
+// away. It returns the number of bytes written.
+func (rs randomStream) copy(w io.Writer, size int) (int, error) {
+	ctx := rs.ctx
+	chunkSize, flushEvery := rs.chunkSize, rs.flushEvery
+	if rs.rate > 0 {
+		// Aim for about ten writes a second so the throttled stream stays
+		// smooth, flushing each one unless flushing was limited to the end.
+		chunkSize = min(chunkSize, max(1, rs.rate/10))
+		if flushEvery > 0 {
+			flushEvery = 1
+		}
+	}
+	buffer := make([]byte, chunkSize)
+	flushCounter := 0
+
+	started := time.Now()
+	written := 0
+	for written < size {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		currentChunk := min(size-written, chunkSize)
+
+		if rs.rate > 0 {
+			// Hold each chunk back until its last byte is due at the
+			// requested rate, so the body never arrives faster than
+			// size/rate.
+			due := started.Add(time.Duration(float64(written+currentChunk) / float64(rs.rate) * float64(time.Second)))
+			if !sleepUntil(ctx, due) {
+				return written, ctx.Err()
+			}
+		}
+
+		if _, err := io.ReadFull(rs.src, buffer[:currentChunk]); err != nil {
+			return written, err
+		}
+		n, err := w.Write(buffer[:currentChunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		flushCounter++
+
+		// Flush every flushEvery chunks (1MB by default) instead of every chunk
+		if rs.flush != nil && flushEvery > 0 && flushCounter%flushEvery == 0 {
+			rs.flush(written)
+		}
+	}
+
+	// Final flush
+	if rs.flush != nil {
+		rs.flush(written)
+	}
+	return written, nil
+}
+
+// sleepUntil blocks until t or until ctx is done, reporting whether t was
+// reached.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// seededReader returns the deterministic stream for seed, advanced by skip
+// bytes so ranges line up with the full body.
+func seededReader(seed int64, skip int) io.Reader {
+	src := mrand.New(mrand.NewSource(seed))
+	if skip > 0 {
+		io.CopyN(io.Discard, src, int64(skip))
+	}
+	return src
+}
+
+// parseRange parses a single "bytes=start-end" Range header against a body
+// of size bytes and returns the inclusive byte offsets it selects. Open-ended
+// ("start-") and suffix ("-n") forms are supported; multiple ranges are not.
+func parseRange(header string, size int) (start, end int, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errors.New("unsupported range")
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes.
+		n, err := strconv.Atoi(last)
+		if err != nil || n <= 0 {
+			return 0, 0, errors.New("invalid range")
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	start, err = strconv.Atoi(first)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errors.New("range not satisfiable")
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, 0, errors.New("invalid range")
+		}
+		end = min(end, size-1)
+	}
+	return start, end, nil
+}
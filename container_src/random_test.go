@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRandomContentLength(t *testing.T) {
+	w := get(newServer(testConfig(t)).routes(), "/random?size=5000")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "5000" {
+		t.Errorf("Content-Length = %q, want 5000", cl)
+	}
+	if w.Body.Len() != 5000 {
+		t.Errorf("body is %d bytes, want 5000", w.Body.Len())
+	}
+}
+
+func TestRandomRange(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		contentRange string
+		length       int
+	}{
+		{"bytes=100-199", http.StatusPartialContent, "bytes 100-199/1000", 100},
+		{"bytes=900-", http.StatusPartialContent, "bytes 900-999/1000", 100},
+		{"bytes=1000-1100", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", -1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/random?size=1000", nil)
+		r.Header.Set("Range", tt.rangeHeader)
+		w := record(h, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.rangeHeader, w.Code, tt.status)
+		}
+		if cr := w.Header().Get("Content-Range"); cr != tt.contentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tt.rangeHeader, cr, tt.contentRange)
+		}
+		if tt.length >= 0 && w.Body.Len() != tt.length {
+			t.Errorf("%s: body is %d bytes, want %d", tt.rangeHeader, w.Body.Len(), tt.length)
+		}
+	}
+}
+
+func TestRandomRejectsBadSizes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxRandomSize = 1000
+	h := newServer(cfg).routes()
+	for _, size := range []string{"1001", "0", "-5", "abc"} {
+		if w := get(h, "/random?size="+size); w.Code != http.StatusBadRequest {
+			t.Errorf("size=%s: status = %d, want 400", size, w.Code)
+		}
+	}
+	if w := get(h, "/random?size=1000"); w.Code != http.StatusOK {
+		t.Errorf("size at the limit: status = %d, want 200", w.Code)
+	}
+}
+
+func TestRandomSeedIsDeterministic(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	a := get(h, "/random?size=4096&seed=42").Body.Bytes()
+	b := get(h, "/random?size=4096&seed=42").Body.Bytes()
+	if len(a) != 4096 || !bytes.Equal(a, b) {
+		t.Errorf("same seed gave different bodies (%d and %d bytes)", len(a), len(b))
+	}
+	if c := get(h, "/random?size=4096&seed=43").Body.Bytes(); bytes.Equal(a, c) {
+		t.Error("different seeds gave the same body")
+	}
+}
+
+func TestRandomTinyChunks(t *testing.T) {
+	t.Setenv("RANDOM_CHUNK_SIZE", "7")
+	t.Setenv("RANDOM_FLUSH_EVERY", "1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RandomChunkSize != 7 || cfg.RandomFlushEvery != 1 {
+		t.Fatalf("chunk size %d, flush every %d; want 7 and 1", cfg.RandomChunkSize, cfg.RandomFlushEvery)
+	}
+	cfg.StorageDir = t.TempDir()
+	if w := get(newServer(cfg).routes(), "/random?size=1000"); w.Body.Len() != 1000 {
+		t.Errorf("body is %d bytes, want 1000", w.Body.Len())
+	}
+}
+
+func TestRandomChecksum(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Seeded: a header computed upfront.
+	w := get(h, "/random?size=3000&seed=7&checksum=1")
+	if got := w.Header().Get("X-Content-SHA256"); got != digest(w.Body.Bytes()) {
+		t.Errorf("seeded: X-Content-SHA256 = %q, want the body's digest", got)
+	}
+
+	// crypto/rand: a trailer sent after the body.
+	resp := get(h, "/random?size=3000&checksum=1").Result()
+	body, _ := io.ReadAll(resp.Body)
+	if got := resp.Trailer.Get("X-Content-SHA256"); got != digest(body) {
+		t.Errorf("trailer X-Content-SHA256 = %q, want the body's digest", got)
+	}
+}
+
+func TestRandomHead(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	w := record(h, httptest.NewRequest(http.MethodHead, "/random?size=5000", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "5000" {
+		t.Errorf("HEAD = %d with Content-Length %q, want 200 and 5000", w.Code, w.Header().Get("Content-Length"))
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("HEAD body is %d bytes, want none", w.Body.Len())
+	}
+}
+
+// cancelingWriter cancels the request's context on the first write, like a
+// client hanging up once the body starts.
+type cancelingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (c *cancelingWriter) Write(b []byte) (int, error) {
+	c.cancel()
+	return c.ResponseRecorder.Write(b)
+}
+
+func TestRandomStopsWhenClientGoes(t *testing.T) {
+	logs := captureLogs(t)
+	h := newServer(testConfig(t)).routes()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelingWriter{httptest.NewRecorder(), cancel}
+
+	start := time.Now()
+	h.ServeHTTP(w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/random?size=104857600", nil))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handler took %v after the client went away", elapsed)
+	}
+	if n := w.Body.Len(); n != 64<<10 {
+		t.Errorf("wrote %d bytes, want just the first chunk", n)
+	}
+	if entry := findLog(t, logs, "random stream truncated"); entry["written"] != float64(64<<10) {
+		t.Errorf("truncation log = %v", entry)
+	}
+}
+
+func TestRandomRate(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	start := time.Now()
+	w := get(h, "/random?size=1000&rate=4000")
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("1000 bytes at 4000 B/s took %v, want at least 250ms", elapsed)
+	}
+	if w.Body.Len() != 1000 {
+		t.Errorf("body is %d bytes, want 1000", w.Body.Len())
+	}
+	if w := get(h, "/random?rate=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("rate=0: status = %d, want 400", w.Code)
+	}
+}
+
+func TestRandomContentType(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	w := get(h, "/random?size=256&type=text/plain")
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if w.Body.Len() != 256 {
+		t.Errorf("body is %d bytes, want 256", w.Body.Len())
+	}
+	if ct := get(h, "/random?size=1").Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("default Content-Type = %q", ct)
+	}
+	if w := get(h, "/random?type=text/x-evil"); w.Code != http.StatusBadRequest {
+		t.Errorf("unlisted type: status = %d, want 400", w.Code)
+	}
+}
+
+// BenchmarkGenerateRandom measures /random's generation loop without the
+// network, at the default chunk and flush settings.
+func BenchmarkGenerateRandom(b *testing.B) {
+	const size = 1 << 20
+	b.SetBytes(size)
+	for b.Loop() {
+		if _, err := generateRandom(io.Discard, size, 64<<10, 16); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// flushCounter counts the flushes a handler makes.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestRandomFlushModes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RandomChunkSize = 100
+	cfg.RandomFlushEvery = 4
+	h := newServer(cfg).routes()
+
+	// 1000 bytes are 10 chunks; every mode but none flushes once more at
+	// the end.
+	for mode, want := range map[string]int{
+		"":      3,
+		"chunk": 11,
+		"end":   1,
+		"none":  0,
+		"bogus": 3,
+	} {
+		w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/random?size=1000&flush="+mode, nil))
+		if w.flushes != want {
+			t.Errorf("flush=%s: %d flushes, want %d", mode, w.flushes, want)
+		}
+		if w.Body.Len() != 1000 {
+			t.Errorf("flush=%s: body is %d bytes, want 1000", mode, w.Body.Len())
+		}
+	}
+}
+
+// failingWriter accepts the first write and fails every one after it, like
+// a connection that broke mid-body.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	f.writes++
+	if f.writes > 1 {
+		return 0, errors.New("broken pipe")
+	}
+	return f.ResponseRecorder.Write(b)
+}
+
+func TestRandomStopsOnWriteError(t *testing.T) {
+	logs := captureLogs(t)
+	h := newServer(testConfig(t)).routes()
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/random?size=1048576", nil))
+
+	if w.writes != 2 {
+		t.Errorf("%d writes, want the loop to stop at the first failure", w.writes)
+	}
+	entry := findLog(t, logs, "random stream truncated")
+	if entry["written"] != float64(64<<10) || entry["error"] != "broken pipe" {
+		t.Errorf("truncation log = %v", entry)
+	}
+}
+
+func TestRandomParts(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	w := get(h, "/random?size=300&parts=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, %v", w.Header().Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	var sizes []int
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cl := part.Header.Get("Content-Length"); cl != "300" {
+			t.Errorf("part Content-Length = %q, want 300", cl)
+		}
+		sizes = append(sizes, len(body))
+	}
+	if len(sizes) != 2 || sizes[0] != 300 || sizes[1] != 300 {
+		t.Errorf("part sizes = %v, want [300 300]", sizes)
+	}
+
+	for _, parts := range []string{"0", "17", "x"} {
+		if w := get(h, "/random?size=10&parts="+parts); w.Code != http.StatusBadRequest {
+			t.Errorf("parts=%s: status = %d, want 400", parts, w.Code)
+		}
+	}
+}
+
+func TestRandomStats(t *testing.T) {
+	logs := captureLogs(t)
+	h := newServer(testConfig(t)).routes()
+	w := get(h, "/random?size=4096&stats=1")
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if len(body) != 4096 {
+		t.Fatalf("body is %d bytes, want 4096", len(body))
+	}
+	if got := resp.Trailer.Get("X-Generated-Bytes"); got != "4096" {
+		t.Errorf("X-Generated-Bytes = %q, want 4096", got)
+	}
+	ms, err := strconv.ParseFloat(resp.Trailer.Get("X-Duration-Ms"), 64)
+	if err != nil || ms <= 0 {
+		t.Errorf("X-Duration-Ms = %q, want a positive duration", resp.Trailer.Get("X-Duration-Ms"))
+	}
+	if entry := findLog(t, logs, "random stream complete"); entry["bytes"] != 4096.0 {
+		t.Errorf("logged bytes = %v, want 4096", entry["bytes"])
+	}
+
+	// Without ?stats=1 there are no trailers, and Content-Length is kept.
+	w = get(h, "/random?size=10")
+	if len(w.Result().Trailer) != 0 || w.Header().Get("Content-Length") != "10" {
+		t.Errorf("trailers %v, Content-Length %q", w.Result().Trailer, w.Header().Get("Content-Length"))
+	}
+}
+
+func TestGenerateRandom(t *testing.T) {
+	w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	n, err := generateRandom(w, 1000, 100, 4)
+	if err != nil || n != 1000 || w.Body.Len() != 1000 {
+		t.Fatalf("wrote %d (%d in the body), %v; want 1000", n, w.Body.Len(), err)
+	}
+	// Every 4 of the 10 chunks, then once at the end.
+	if w.flushes != 3 {
+		t.Errorf("flushes = %d, want 3", w.flushes)
+	}
+}
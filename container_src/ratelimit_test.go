@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := newRateLimiter(1, 3)
+	h := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		func() *rateLimiter { return limiter })
+
+	from := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr
+		return record(h, r)
+	}
+	for i := range 3 {
+		if w := from("192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d within burst: status = %d", i+1, w.Code)
+		}
+	}
+	w := from("192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: status = %d, want 429", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "1" {
+		t.Errorf("Retry-After = %q, want 1", ra)
+	}
+	if w := from("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("other client: status = %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(2, 1)
+	now := time.Now()
+	if ok, _ := l.allow("a", now); !ok {
+		t.Fatal("first request refused")
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("allow() = %v, %v; want refused with 500ms to wait", ok, wait)
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("not refilled after 500ms")
+	}
+}
+
+func TestRateLimitMiddlewareDisabled(t *testing.T) {
+	h := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		func() *rateLimiter { return nil })
+	for range 10 {
+		if w := get(h, "/"); w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+)
+
+// liveConfig is the configuration in effect. On SIGHUP the settings that
+// can change at runtime are reloaded into a fresh copy and swapped in; the
+// rest keep the values the process started with.
+type liveConfig struct {
+	cfg      atomic.Pointer[Config]
+	limiter  atomic.Pointer[rateLimiter]
+	logLevel *slog.LevelVar
+}
+
+func newLiveConfig(cfg Config, logLevel *slog.LevelVar) *liveConfig {
+	l := &liveConfig{logLevel: logLevel}
+	l.store(&cfg)
+	return l
+}
+
+// Load returns the current configuration. It must not be modified.
+func (l *liveConfig) Load() *Config {
+	return l.cfg.Load()
+}
+
+// RateLimiter returns the limiter for the current RATE_LIMIT_RPS, or nil
+// when rate limiting is off.
+func (l *liveConfig) RateLimiter() *rateLimiter {
+	return l.limiter.Load()
+}
+
+func (l *liveConfig) store(cfg *Config) {
+	prev := l.cfg.Swap(cfg)
+	l.logLevel.Set(cfg.LogLevel)
+	// Clients' buckets are only reset when the limit itself changes.
+	if prev == nil || prev.RateLimitRPS != cfg.RateLimitRPS || prev.RateLimitBurst != cfg.RateLimitBurst {
+		var limiter *rateLimiter
+		if cfg.RateLimitRPS > 0 {
+			limiter = newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+		}
+		l.limiter.Store(limiter)
+	}
+}
+
+// copyReloadable copies the settings that can change at runtime from src
+// to dst.
+func copyReloadable(dst, src *Config) {
+	dst.LogLevel = src.LogLevel
+	dst.ExtraHeaders = src.ExtraHeaders
+	dst.RateLimitRPS = src.RateLimitRPS
+	dst.RateLimitBurst = src.RateLimitBurst
+}
+
+// reload loads the configuration again and applies its reloadable settings.
+// Changes to anything else, such as PORT, are ignored with a warning, and an
+// invalid configuration leaves the current one in place.
+func (l *liveConfig) reload() {
+	next, err := LoadConfig()
+	if err != nil {
+		slog.Error("invalid configuration, keeping the current one", "error", err)
+		return
+	}
+	cur := l.Load()
+	if ignored := changedFields(cur, &next); len(ignored) > 0 {
+		slog.Warn("config changes need a restart to take effect", "fields", ignored)
+	}
+	updated := *cur
+	copyReloadable(&updated, &next)
+	l.store(&updated)
+	slog.Info("config reloaded", "log_level", updated.LogLevel.String(),
+		"extra_headers", len(updated.ExtraHeaders), "rate_limit_rps", updated.RateLimitRPS)
+}
+
+// changedFields names the fields other than the reloadable ones that differ
+// between cur and next.
+func changedFields(cur, next *Config) []string {
+	probe := *next
+	copyReloadable(&probe, cur)
+	a, b := reflect.ValueOf(*cur), reflect.ValueOf(probe)
+	var changed []string
+	for i := range a.NumField() {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, a.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// watchReload reloads l on every SIGHUP until ctx is done. The env is the
+// process's own and doesn't change from outside, so in a container new
+// values normally come from CONFIG_FILE.
+func watchReload(ctx context.Context, l *liveConfig) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			l.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
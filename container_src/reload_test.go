@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// loadLive loads the config from the env and wraps it the way main does.
+func loadLive(t *testing.T) (*liveConfig, *slog.LevelVar) {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := new(slog.LevelVar)
+	return newLiveConfig(cfg, level), level
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	// Keep SIGHUP from killing the test binary before watchReload has
+	// registered for it.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	defer signal.Stop(guard)
+
+	live, level := loadLive(t)
+	if level.Level() != slog.LevelInfo {
+		t.Fatalf("initial level = %v, want info", level.Level())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchReload(ctx, live)
+
+	t.Setenv("LOG_LEVEL", "debug")
+	// Signal until the reload lands, as watchReload may not be listening yet.
+	deadline := time.Now().Add(5 * time.Second)
+	for level.Level() != slog.LevelDebug {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGHUP didn't reload LOG_LEVEL")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if live.Load().LogLevel != slog.LevelDebug {
+		t.Errorf("live LogLevel = %v, want debug", live.Load().LogLevel)
+	}
+}
+
+func TestReloadFromConfigFile(t *testing.T) {
+	writeConfigFile(t, `{"port": "8080", "rate_limit_rps": 0}`)
+	live, _ := loadLive(t)
+	if live.RateLimiter() != nil {
+		t.Fatal("rate limiter set with rate limiting off")
+	}
+
+	logs := captureLogs(t)
+	writeConfigFile(t, `{"port": "9090", "rate_limit_rps": 5, "extra_headers": {"X-Env": "staging"}}`)
+	live.reload()
+
+	cfg := live.Load()
+	if cfg.Port != "8080" {
+		t.Errorf("Port = %q, want the startup 8080", cfg.Port)
+	}
+	if cfg.RateLimitRPS != 5 || live.RateLimiter() == nil {
+		t.Errorf("RateLimitRPS = %v with limiter %v, want 5 and a limiter", cfg.RateLimitRPS, live.RateLimiter())
+	}
+	if cfg.ExtraHeaders["X-Env"] != "staging" {
+		t.Errorf("ExtraHeaders = %v, want X-Env", cfg.ExtraHeaders)
+	}
+	fields, _ := findLog(t, logs, "config changes need a restart to take effect")["fields"].([]any)
+	if !slices.Equal(fields, []any{"Port"}) {
+		t.Errorf("ignored fields = %v, want [Port]", fields)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	writeConfigFile(t, `{"rate_limit_rps": 5}`)
+	live, _ := loadLive(t)
+	limiter := live.RateLimiter()
+
+	logs := captureLogs(t)
+	writeConfigFile(t, `{"rate_limit_rps": "lots"}`)
+	live.reload()
+	findLog(t, logs, "invalid configuration, keeping the current one")
+	if live.Load().RateLimitRPS != 5 || live.RateLimiter() != limiter {
+		t.Errorf("config changed by an invalid reload: RateLimitRPS = %v", live.Load().RateLimitRPS)
+	}
+}
+
+func TestChangedFieldsIgnoresReloadable(t *testing.T) {
+	cur := defaultConfig()
+	next := cur
+	next.LogLevel = slog.LevelDebug
+	next.RateLimitRPS = 10
+	if changed := changedFields(&cur, &next); len(changed) != 0 {
+		t.Errorf("changedFields = %v, want none", changed)
+	}
+	next.MaxBodyBytes++
+	if changed := changedFields(&cur, &next); !slices.Equal(changed, []string{"MaxBodyBytes"}) {
+		t.Errorf("changedFields = %v, want [MaxBodyBytes]", changed)
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Server holds the state shared by the HTTP handlers.
+type Server struct {
+	cfg    Config
+	visits CounterStore
+	async  *AsyncCounterStore // set when ASYNC_COUNTER=true; wraps visits
+	logger *slog.Logger
+
+	keyedMu sync.Mutex
+	keyed   map[string]CounterStore // per-key counters behind /count/{key}
+
+	draining     atomic.Bool   // set on SIGTERM; /ready fails from then on
+	shutdown     chan struct{} // closed by /admin/shutdown
+	shutdownOnce sync.Once
+
+	idempotency *idempotencyCache // visit numbers by Idempotency-Key
+
+	greeting *template.Template // GREETING_TEMPLATE; nil uses the default text
+}
+
+// NewServer builds a Server for cfg and returns its routes.
+func NewServer(cfg Config) *http.ServeMux {
+	return newServer(cfg).routes()
+}
+
+func newServer(cfg Config) *Server {
+	logger := slog.Default()
+	s := &Server{
+		cfg:    cfg,
+		logger: logger,
+		keyed:  make(map[string]CounterStore),
+
+		shutdown: make(chan struct{}),
+
+		idempotency: newIdempotencyCache(idempotencyTTL, idempotencyCapacity),
+	}
+	if cfg.GreetingTemplate != "" {
+		// A trial run catches references to fields that don't exist, which
+		// would otherwise only fail per request.
+		t, err := template.New("greeting").Parse(cfg.GreetingTemplate)
+		if err == nil {
+			err = t.Execute(io.Discard, rootResponse{})
+		}
+		if err != nil {
+			logger.Error("invalid GREETING_TEMPLATE, using the default greeting", "error", err)
+		} else {
+			s.greeting = t
+		}
+	}
+	if cfg.DryRun {
+		s.visits = &MemoryCounterStore{}
+		return s
+	}
+	file := NewFileCounterStore(counterPath(cfg.StorageDir), cfg.StorageDirMode, cfg.StorageFileMode, logger)
+	s.visits = file
+	if cfg.AsyncCounter {
+		s.async = NewAsyncCounterStore(file)
+		s.visits = s.async
+	}
+	return s
+}
+
+// Start runs the server's background work until ctx is done.
+func (s *Server) Start(ctx context.Context) {
+	if s.async != nil {
+		go s.async.Run(ctx, s.cfg.AsyncFlushInterval)
+	}
+}
+
+// Drain marks the server as going away so /ready reports 503 and the
+// platform stops routing new traffic to it. Requests are still served.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Close persists any state still held in memory. Call it once the HTTP
+// server has stopped handling requests.
+func (s *Server) Close() error {
+	if s.async != nil {
+		return s.async.Flush()
+	}
+	return nil
+}
+
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Routes live under BASE_PATH. GET patterns also match HEAD; the mux
+	// answers any other method with 405 and an Allow header.
+	handle := func(method, path string, h http.HandlerFunc) {
+		mux.HandleFunc(method+" "+s.cfg.BasePath+path, h)
+	}
+	// Probes can stay at the root so platform health checks don't need to
+	// know the prefix.
+	probe := handle
+	if s.cfg.HealthAtRoot {
+		probe = func(method, path string, h http.HandlerFunc) {
+			mux.HandleFunc(method+" "+path, h)
+		}
+	}
+
+	// {$} keeps the root from matching every path nothing else claimed, so
+	// typos get a 404 instead of counting as visits.
+	handle("GET", "/{$}", s.handleRoot)
+	handle("GET", "/container", s.handleRoot)
+	// Browsers ask for the icon at the root whatever the base path is.
+	mux.HandleFunc("GET /favicon.ico", handleFavicon)
+	probe("GET", "/health", s.handleHealth)
+	probe("GET", "/ready", s.handleReady)
+	handle("GET", "/reset", s.handleReset)
+	handle("GET", "/env", s.handleEnv)
+	handle("GET", "/counter", s.handleCounter)
+	handle("GET", "/count/{key}", s.handleCount)
+	handle("GET", "/counters", s.handleCounters)
+	handle("GET", "/version", s.handleVersion)
+	handle("GET", "/uptime", s.handleUptime)
+	handle("GET", "/metrics", metrics.ServeHTTP)
+
+	// Endpoints a locked-down deployment can switch off. Disabled ones are
+	// routed to the 404 handler so the SPA fallback doesn't pick them up.
+	optional := func(disabled bool) func(method, path string, h http.HandlerFunc) {
+		if !disabled {
+			return handle
+		}
+		return func(method, path string, _ http.HandlerFunc) {
+			handle(method, path, notFound)
+		}
+	}
+	errorRoute := optional(s.cfg.DisableError)
+	errorRoute("GET", "/error", s.handleError)
+	errorRoute("GET", "/slowpanic", s.handleSlowPanic)
+	optional(s.cfg.DisableRandom)("GET", "/random", s.handleRandom)
+	debugRoute := optional(s.cfg.DisableDebug)
+	debugRoute("GET", "/sleep", s.handleSleep)
+	debugRoute("GET", "/delay-headers", s.handleDelayHeaders)
+	debugRoute("GET", "/stream", s.handleStream)
+	debugRoute("GET", "/cpu", s.handleCPU)
+	debugRoute("GET", "/mem", s.handleMem)
+	debugRoute("GET", "/echo", s.handleEcho)
+	debugRoute("POST", "/echo", s.handleEcho)
+	debugRoute("PUT", "/echo", s.handleEcho)
+	debugRoute("POST", "/upload", s.handleUpload)
+	debugRoute("GET", "/whoami", s.handleWhoami)
+	debugRoute("GET", "/time", s.handleTime)
+
+	if s.cfg.AdminToken != "" {
+		s.registerAdmin(handle)
+	}
+	if s.cfg.EnablePprof {
+		s.registerPprof(mux)
+	}
+	return mux
+}
+
+// registerPprof mounts the net/http/pprof handlers. They expect to live at
+// /debug/pprof/, so BASE_PATH is stripped before they see the request.
+func (s *Server) registerPprof(mux *http.ServeMux) {
+	prefix := s.cfg.BasePath + "/debug/pprof/"
+	strip := func(h http.HandlerFunc) http.Handler {
+		return http.StripPrefix(s.cfg.BasePath, h)
+	}
+	mux.Handle("GET "+prefix, strip(pprof.Index))
+	mux.Handle("GET "+prefix+"cmdline", strip(pprof.Cmdline))
+	mux.Handle("GET "+prefix+"profile", strip(pprof.Profile))
+	mux.Handle("GET "+prefix+"symbol", strip(pprof.Symbol))
+	mux.Handle("POST "+prefix+"symbol", strip(pprof.Symbol))
+	mux.Handle("GET "+prefix+"trace", strip(pprof.Trace))
+}
+
+// handleRoot greets the caller and counts the visit. Responses carry an ETag
+// of their body. Revalidations (If-None-Match) and HEAD requests don't count
+// as visits: they are answered from the current count, with 304 when the tag
+// still matches. A revalidation whose tag is stale counts as a fresh visit.
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	status, ok := statusParam(r)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "status must be an HTTP status code between 200 and 599")
+		return
+	}
+
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" || r.Method == http.MethodHead {
+		// With storage down Get still returns the in-memory fallback, which
+		// is what these are answered from; they never count.
+		current, err := s.visits.Get()
+		if err != nil {
+			w.Header().Set("X-Storage", "unavailable")
+		}
+		body, contentType := s.renderRoot(r, current)
+		etag := etagFor(body)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Visit-Count", strconv.Itoa(current))
+		if status == http.StatusOK && etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKey {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d bytes", maxIdempotencyKey))
+		return
+	}
+
+	var counter int
+	var err error
+	switch {
+	case skipCount(r):
+		counter, err = s.visits.Get()
+	case idempotencyKey != "":
+		// A retry with the same key gets the visit number of the first
+		// attempt rather than counting again.
+		var replayed bool
+		counter, replayed, err = s.idempotency.do(idempotencyKey, time.Now(), s.visits.Increment)
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+			break
+		}
+		s.logVisit(r, counter)
+	default:
+		// Test writing to persistent storage
+		counter, err = s.visits.Increment()
+		s.logVisit(r, counter)
+	}
+	if err != nil {
+		w.Header().Set("X-Storage", "unavailable")
+	}
+
+	body, contentType := s.renderRoot(r, counter)
+	w.Header().Set("X-Visit-Count", strconv.Itoa(counter))
+	w.Header().Set("ETag", etagFor(body))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// statusParam reads the ?status=N the root handler answers with, so callers
+// can exercise their handling of non-200 responses. It defaults to 200 and
+// must be a final status, 200 to 599: a 1xx would leave the client waiting
+// for a final response that never comes. Statuses that forbid a body, like
+// 204 and 304, go out without one.
+func statusParam(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("status")
+	if v == "" {
+		return http.StatusOK, true
+	}
+	status, err := strconv.Atoi(v)
+	if err != nil || status < 200 || status > 599 {
+		return 0, false
+	}
+	return status, true
+}
+
+func (s *Server) logVisit(r *http.Request, counter int) {
+	s.logger.Info("visit", "request_id", RequestIDFromContext(r.Context()),
+		"instance_id", s.cfg.InstanceID, "visit", counter, "path", r.URL.Path)
+}
+
+// handleCounter reports the visit count as JSON without incrementing it, so
+// monitoring can poll it.
+func (s *Server) handleCounter(w http.ResponseWriter, r *http.Request) {
+	counter, err := s.visits.Get()
+	if err != nil {
+		w.Header().Set("X-Storage", "unavailable")
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"visits": counter})
+}
+
+// handleFavicon answers browsers' automatic icon requests with an empty
+// response, so they neither 404 nor count as visits.
+func handleFavicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// skipCount reports whether the request asked, with ?count=false or an
+// X-Skip-Count: true header, to be answered without counting as a visit.
+// Probes use it to avoid inflating the counter.
+func skipCount(r *http.Request) bool {
+	if count, err := strconv.ParseBool(r.URL.Query().Get("count")); err == nil && !count {
+		return true
+	}
+	skip, _ := strconv.ParseBool(r.Header.Get("X-Skip-Count"))
+	return skip
+}
+
+// renderRoot builds the greeting for counter, as JSON or plain text depending
+// on the Accept header.
+func (s *Server) renderRoot(r *http.Request, counter int) (body []byte, contentType string) {
+	secret := s.cfg.Secret
+	if !s.revealSecret(r) {
+		secret = maskSecret(secret)
+	}
+
+	data := rootResponse{
+		Message:  s.cfg.Message,
+		Secret:   secret,
+		Instance: s.cfg.InstanceID,
+		Visit:    counter,
+	}
+	if wantsJSON(r) {
+		body, _ = json.Marshal(data)
+		return append(body, '\n'), "application/json"
+	}
+
+	if s.greeting != nil {
+		var buf bytes.Buffer
+		err := s.greeting.Execute(&buf, data)
+		if err == nil {
+			return buf.Bytes(), "text/plain; charset=utf-8"
+		}
+		s.logger.Error("greeting template failed, using the default", "error", err)
+	}
+	messageToPrint := fmt.Sprintf("Hi, I'm a container! Message: %s, Secret: %s, Instance: %s, Visit: %d",
+		quoteOrUnset(s.cfg.Message), quoteOrUnset(secret), s.cfg.InstanceID, counter)
+	return []byte(messageToPrint), "text/plain; charset=utf-8"
+}
+
+// etagFor returns a strong entity tag for body.
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// rootResponse is the JSON form of the root handler's greeting.
+type rootResponse struct {
+	Message  string `json:"message"`
+	Secret   string `json:"secret"`
+	Instance string `json:"instance"`
+	Visit    int    `json:"visit"`
+}
+
+// wantsJSON reports whether the client's Accept header asks for JSON.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// revealSecret reports whether the caller asked for ?reveal=1 and the
+// deployment opted into it with ALLOW_SECRET_REVEAL=true.
+func (s *Server) revealSecret(r *http.Request) bool {
+	return s.cfg.AllowSecretReveal && r.URL.Query().Get("reveal") == "1"
+}
+
+// maskSecret hides the secret value, leaving empty secrets visibly empty.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
+
+// quoteOrUnset quotes v for the plain-text greeting, or says "(unset)" when
+// it is empty so a missing variable doesn't look like a rendering bug. JSON
+// responses keep the empty string.
+func quoteOrUnset(v string) string {
+	if v == "" {
+		return "(unset)"
+	}
+	return `"` + v + `"`
+}
+
+// counterPath is where the visit counter is persisted under dir.
+func counterPath(dir string) string {
+	return filepath.Join(dir, "visit_counter.txt")
+}
+
+// handleReset clears the visit counter. It only exists when ENABLE_RESET=true
+// and 404s otherwise.
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.EnableReset {
+		notFound(w, r)
+		return
+	}
+	if err := s.visits.Reset(); err != nil {
+		s.logger.Error("failed to reset counter", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to reset counter")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "reset")
+}
+
+// healthLockTimeout is how long /health waits for the counter lock before
+// reporting degraded.
+const healthLockTimeout = time.Second
+
+// handleHealth is a liveness probe. It deliberately avoids storage and config
+// so it stays cheap and never leaks configuration, but reports degraded when
+// the counter lock looks deadlocked. Clients asking for JSON also get the
+// process's instance UUID.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status, code := "ok", http.StatusOK
+	// A counter lock that can't be taken for this long means a request is
+	// stuck holding it; failing liveness gets the instance restarted.
+	if p, ok := s.visits.(lockProber); ok && !p.lockFree(healthLockTimeout) {
+		s.logger.Error("counter lock held too long, reporting degraded", "timeout", healthLockTimeout.String())
+		status, code = "degraded", http.StatusServiceUnavailable
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, code, map[string]any{
+			"status":          status,
+			"instance_uuid":   instanceUUID,
+			"active_requests": metrics.Active(),
+			"total_requests":  metrics.Served(),
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(code)
+	fmt.Fprint(w, status)
+}
+
+// handleReady is a readiness probe that reports 503 during the WARMUP_SECONDS
+// after boot and until the storage dir accepts writes, so traffic is held
+// until the instance is primed and the persistent volume is mounted, and
+// again once the server starts draining for shutdown.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if remaining := s.cfg.Warmup - time.Since(startTime); remaining > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not ready: warming up")
+		return
+	}
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not ready: shutting down")
+		return
+	}
+	if !s.cfg.DryRun {
+		if err := checkStorageWritable(s.cfg.StorageDir); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %v", err)
+			return
+		}
+	}
+	fmt.Fprint(w, "ready")
+}
+
+// checkStorageWritable creates and removes a temp file in dir.
+func checkStorageWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".ready-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// handleEnv dumps the resolved non-secret configuration as JSON. It only
+// exists when ENABLE_ENV_DEBUG=true and never includes MYSECRET.
+func (s *Server) handleEnv(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.EnableEnvDebug {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"message":         s.cfg.Message,
+		"instance_id":     s.cfg.InstanceID,
+		"port":            s.cfg.Port,
+		"storage_dir":     s.cfg.StorageDir,
+		"max_random_size": s.cfg.MaxRandomSize,
+	})
+}
+
+// handleCounters returns every keyed counter found in the counters dir as a
+// key-to-count JSON object, without incrementing any of them.
+func (s *Server) handleCounters(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.DryRun {
+		// Nothing is on disk; the counters made so far are all there is.
+		s.keyedMu.Lock()
+		counts := make(map[string]int, len(s.keyed))
+		for key, c := range s.keyed {
+			counts[key], _ = c.Get()
+		}
+		s.keyedMu.Unlock()
+		writeJSON(w, http.StatusOK, counts)
+		return
+	}
+
+	entries, err := os.ReadDir(s.countersDir())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Warn("failed to list counters", "dir", s.countersDir(), "error", err)
+		w.Header().Set("X-Storage", "unavailable")
+		writeJSONError(w, http.StatusServiceUnavailable, "failed to list counters")
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), ".txt")
+		if !ok || e.IsDir() || !validCounterKey(key) {
+			continue
+		}
+		count, err := s.keyedCounter(key).Get()
+		if err != nil {
+			w.Header().Set("X-Storage", "unavailable")
+		}
+		counts[key] = count
+	}
+
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// handleCount increments and returns the named counter stored under
+// counters/ in the storage dir.
+func (s *Server) handleCount(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !validCounterKey(key) {
+		writeJSONError(w, http.StatusBadRequest, "invalid counter key")
+		return
+	}
+
+	count, err := s.keyedCounter(key).Increment()
+	if err != nil {
+		w.Header().Set("X-Storage", "unavailable")
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "count": count})
+}
+
+// countersDir is where the keyed counters live.
+func (s *Server) countersDir() string {
+	return filepath.Join(s.cfg.StorageDir, "counters")
+}
+
+// keyedCounter returns the store for key, creating it on first use so every
+// request for the same key shares one lock.
+func (s *Server) keyedCounter(key string) CounterStore {
+	s.keyedMu.Lock()
+	defer s.keyedMu.Unlock()
+
+	c, ok := s.keyed[key]
+	if !ok {
+		if s.cfg.DryRun {
+			c = &MemoryCounterStore{}
+		} else {
+			c = NewFileCounterStore(filepath.Join(s.countersDir(), key+".txt"),
+				s.cfg.StorageDirMode, s.cfg.StorageFileMode, s.logger)
+		}
+		s.keyed[key] = c
+	}
+	return c
+}
+
+// validCounterKey restricts keys to a plain file name so they can't escape
+// the counters directory.
+func validCounterKey(key string) bool {
+	if key == "" || len(key) > 64 {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// maxPanicMessage caps the ?msg= /error panics with.
+const maxPanicMessage = 256
+
+// handleError panics to exercise recoverMiddleware, with ?msg= as the panic
+// value if given so alerting on distinct panic signatures can be tested.
+// With ?json=1 it instead answers with a fixed JSON 500, for callers that
+// want a predictable body.
+func (s *Server) handleError(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("json") == "1" {
+		writeJSONError(w, http.StatusInternalServerError, "intentional panic")
+		return
+	}
+	if msg := truncateUTF8(stripControl(r.URL.Query().Get("msg")), maxPanicMessage); msg != "" {
+		panic(msg)
+	}
+	panic("This is a panic")
+}
+
+// handleSlowPanic starts streaming a response and panics partway through, to
+// exercise recovery once headers are already on the wire.
+func (s *Server) handleSlowPanic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "working...")
+	http.NewResponseController(w).Flush()
+	time.Sleep(100 * time.Millisecond)
+	panic("This is a panic after the response started")
+}
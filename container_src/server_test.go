@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Handlers log every visit; keep test output readable.
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testConfig returns the default config with storage in a fresh temp dir.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.StorageDir = t.TempDir()
+	return cfg
+}
+
+// record serves r with h and returns the response.
+func record(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// get serves a GET for target with h.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	return record(h, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// logBuffer collects log output. Handlers may still be logging from server
+// goroutines while a test reads it, hence the lock.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the default logger to a buffer, at debug level, for the
+// rest of the test. Call it before newServer, which keeps the default.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	logs := new(logBuffer)
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return logs
+}
+
+// findLog returns the first JSON log entry in logs with the given msg,
+// failing the test if there is none.
+func findLog(t *testing.T, logs *logBuffer, msg string) map[string]any {
+	t.Helper()
+	for line := range strings.Lines(logs.String()) {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["msg"] == msg {
+			return entry
+		}
+	}
+	t.Fatalf("no %q logged in %q", msg, logs)
+	return nil
+}
+
+func TestRootConcurrentVisits(t *testing.T) {
+	cfg := testConfig(t)
+	h := newServer(cfg).routes()
+
+	const requests = 200
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := get(h, "/"); w.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(counterPath(cfg.StorageDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := decodeCounter(data); err != nil || n != requests {
+		t.Errorf("stored counter = %d, %v; want %d", n, err, requests)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	cfg := testConfig(t)
+	h := newServer(cfg).routes()
+
+	w := get(h, "/health")
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("GET /health = %d %q, want 200 \"ok\"", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if _, err := os.Stat(counterPath(cfg.StorageDir)); !os.IsNotExist(err) {
+		t.Errorf("counter file touched by /health: %v", err)
+	}
+}
+
+func TestHealthDegradedWhileCounterLocked(t *testing.T) {
+	s := newServer(testConfig(t))
+	h := s.routes()
+	store := s.visits.(*FileCounterStore)
+	store.mu.Lock()
+	w := get(h, "/health")
+	store.mu.Unlock()
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "degraded" {
+		t.Errorf("GET /health = %d %q, want 503 \"degraded\"", w.Code, w.Body)
+	}
+	if w := get(h, "/health"); w.Code != http.StatusOK {
+		t.Errorf("after unlock: status = %d, want 200", w.Code)
+	}
+}
+
+func TestReady(t *testing.T) {
+	cfg := testConfig(t)
+	if w := get(newServer(cfg).routes(), "/ready"); w.Code != http.StatusOK || w.Body.String() != "ready" {
+		t.Errorf("GET /ready = %d %q, want 200 \"ready\"", w.Code, w.Body)
+	}
+}
+
+func TestReadyUnwritableStorage(t *testing.T) {
+	cfg := testConfig(t)
+	// chmod doesn't stop root, so park the storage dir under a regular
+	// file, which no user can create entries in.
+	file := filepath.Join(cfg.StorageDir, "file")
+	if err := os.WriteFile(file, nil, 0o444); err != nil {
+		t.Fatal(err)
+	}
+	cfg.StorageDir = filepath.Join(file, "storage")
+
+	w := get(newServer(cfg).routes(), "/ready")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	if !strings.HasPrefix(w.Body.String(), "not ready: ") {
+		t.Errorf("body = %q, want the reason", w.Body)
+	}
+}
+
+func TestVisitLogIsJSONWithoutSecret(t *testing.T) {
+	logs := captureLogs(t)
+	cfg := testConfig(t)
+	cfg.Secret = "hunter2"
+	cfg.InstanceID = "i-1"
+	get(newServer(cfg).routes(), "/")
+
+	entry := findLog(t, logs, "visit")
+	for _, key := range []string{"instance_id", "visit", "path"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("visit log lacks %q: %v", key, entry)
+		}
+	}
+	if strings.Contains(logs.String(), cfg.Secret) {
+		t.Errorf("logs leak the secret: %q", logs)
+	}
+}
+
+func TestRootSecretReveal(t *testing.T) {
+	tests := []struct {
+		allow  bool
+		target string
+		reveal bool
+	}{
+		{false, "/", false},
+		{false, "/?reveal=1", false},
+		{true, "/", false},
+		{true, "/?reveal=1", true},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(t)
+		cfg.Secret = "hunter2"
+		cfg.AllowSecretReveal = tt.allow
+		body := get(newServer(cfg).routes(), tt.target).Body.String()
+		if got := strings.Contains(body, "hunter2"); got != tt.reveal {
+			t.Errorf("allow=%v %s: body %q, want revealed=%v", tt.allow, tt.target, body, tt.reveal)
+		}
+		if !tt.reveal && !strings.Contains(body, `Secret: "***"`) {
+			t.Errorf("allow=%v %s: body %q lacks the mask", tt.allow, tt.target, body)
+		}
+	}
+}
+
+func TestRootContentNegotiation(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Message = "hello"
+	cfg.Secret = "hunter2"
+	cfg.InstanceID = "i-1"
+	h := newServer(cfg).routes()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w := record(h, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("JSON Content-Type = %q", ct)
+	}
+	var got rootResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %q: %v", w.Body, err)
+	}
+	if want := (rootResponse{Message: "hello", Secret: "***", Instance: "i-1", Visit: 1}); got != want {
+		t.Errorf("JSON body = %+v, want %+v", got, want)
+	}
+
+	w = get(h, "/")
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("plain Content-Type = %q", ct)
+	}
+	want := `Hi, I'm a container! Message: "hello", Secret: "***", Instance: i-1, Visit: 2`
+	if w.Body.String() != want {
+		t.Errorf("plain body = %q, want %q", w.Body, want)
+	}
+}
+
+func TestCounterFileInStorageDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "storage")
+	t.Setenv("STORAGE_DIR", dir)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(newServer(cfg).routes(), "/")
+	if _, err := os.Stat(filepath.Join(dir, "visit_counter.txt")); err != nil {
+		t.Errorf("counter file not under STORAGE_DIR: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	cfg := testConfig(t)
+	h := newServer(cfg).routes()
+	if w := get(h, "/reset"); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status = %d, want 404", w.Code)
+	}
+
+	cfg.EnableReset = true
+	h = newServer(cfg).routes()
+	get(h, "/")
+	get(h, "/")
+	if w := get(h, "/reset"); w.Code != http.StatusOK || w.Body.String() != "reset" {
+		t.Errorf("enabled: GET /reset = %d %q, want 200 \"reset\"", w.Code, w.Body)
+	}
+	if w := get(h, "/"); !strings.HasSuffix(w.Body.String(), "Visit: 1") {
+		t.Errorf("after reset got %q, want visit 1", w.Body)
+	}
+}
+
+func TestVisitCountHeader(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	for want := 1; want <= 3; want++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", "application/json")
+		w := record(h, r)
+		var body rootResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Header().Get("X-Visit-Count"); got != strconv.Itoa(want) || body.Visit != want {
+			t.Errorf("X-Visit-Count %q, body visit %d; want %d", got, body.Visit, want)
+		}
+	}
+}
+
+func TestRootWithoutStorage(t *testing.T) {
+	cfg := testConfig(t)
+	blocker := filepath.Join(cfg.StorageDir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A dir under a regular file can't be created, even by root.
+	cfg.StorageDir = filepath.Join(blocker, "storage")
+	h := newServer(cfg).routes()
+
+	for want := 1; want <= 2; want++ {
+		w := get(h, "/")
+		if w.Code != http.StatusOK || w.Header().Get("X-Storage") != "unavailable" {
+			t.Errorf("status %d, X-Storage %q; want 200 and unavailable", w.Code, w.Header().Get("X-Storage"))
+		}
+		if got := w.Header().Get("X-Visit-Count"); got != strconv.Itoa(want) {
+			t.Errorf("in-memory count = %s, want %d", got, want)
+		}
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	w := get(h, "/")
+	if w.Header().Get("X-Storage") != "" {
+		t.Errorf("X-Storage = %q after storage came back", w.Header().Get("X-Storage"))
+	}
+	if _, err := os.Stat(counterPath(cfg.StorageDir)); err != nil {
+		t.Errorf("counter not persisted after recovery: %v", err)
+	}
+}
+
+func TestEnvEndpoint(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Secret = "hunter2"
+	if w := get(newServer(cfg).routes(), "/env"); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status = %d, want 404", w.Code)
+	}
+
+	cfg.EnableEnvDebug = true
+	w := get(newServer(cfg).routes(), "/env")
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("enabled: GET /env = %d %q: %v", w.Code, w.Body, err)
+	}
+	if body["storage_dir"] != cfg.StorageDir {
+		t.Errorf("storage_dir = %v, want %q", body["storage_dir"], cfg.StorageDir)
+	}
+	if strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("/env leaks the secret: %s", w.Body)
+	}
+}
+
+func TestKeyedCounters(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	count := func(key string) any {
+		var body map[string]any
+		json.Unmarshal(get(h, "/count/"+key).Body.Bytes(), &body)
+		return body["count"]
+	}
+	count("a")
+	count("a")
+	if got := count("b"); got != 1.0 {
+		t.Errorf("b = %v, want 1", got)
+	}
+	if got := count("a"); got != 3.0 {
+		t.Errorf("a = %v, want 3", got)
+	}
+
+	for _, key := range []string{"..%2Fetc", "a.b", "%2Fetc"} {
+		if w := get(h, "/count/"+key); w.Code != http.StatusBadRequest {
+			t.Errorf("key %q: status = %d, want 400", key, w.Code)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	cfg := testConfig(t)
+	mux := NewServer(cfg)
+	if mux == nil {
+		t.Fatal("NewServer returned nil")
+	}
+	if w := get(mux, "/"); w.Code != http.StatusOK || w.Header().Get("X-Visit-Count") != "1" {
+		t.Errorf("GET / = %d with visit %q, want 200 and 1", w.Code, w.Header().Get("X-Visit-Count"))
+	}
+	if _, err := os.Stat(counterPath(cfg.StorageDir)); err != nil {
+		t.Errorf("counter not stored in the injected dir: %v", err)
+	}
+}
+
+func TestRootRejectsPost(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	w := record(h, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want 405", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("Allow = %q, want \"GET, HEAD\"", allow)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BasePath = "/app"
+	h := newServer(cfg).routes()
+	for target, want := range map[string]int{
+		"/app/":          http.StatusOK,
+		"/app/container": http.StatusOK,
+		"/app/random":    http.StatusOK,
+		"/app/health":    http.StatusOK,
+		"/":              http.StatusNotFound,
+		"/random":        http.StatusNotFound,
+		"/health":        http.StatusNotFound,
+	} {
+		if w := get(h, target); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, want)
+		}
+	}
+
+	cfg.HealthAtRoot = true
+	h = newServer(cfg).routes()
+	if w := get(h, "/health"); w.Code != http.StatusOK {
+		t.Errorf("HEALTH_AT_ROOT: GET /health = %d, want 200", w.Code)
+	}
+}
+
+func TestRootETag(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	w := get(h, "/")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag != etagFor(w.Body.Bytes()) {
+		t.Fatalf("GET / = %d with ETag %q, want 200 and the body's tag", w.Code, etag)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = record(h, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidation = %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+	if n := w.Header().Get("X-Visit-Count"); n != "1" {
+		t.Errorf("304 counted a visit: X-Visit-Count = %s", n)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"stale"`)
+	if w := record(h, r); w.Code != http.StatusOK || w.Header().Get("X-Visit-Count") != "2" {
+		t.Errorf("stale tag = %d with visit %s, want 200 and 2", w.Code, w.Header().Get("X-Visit-Count"))
+	}
+}
+
+func TestRootRecoversFromCorruptCounter(t *testing.T) {
+	logs := captureLogs(t)
+	cfg := testConfig(t)
+	if err := os.WriteFile(counterPath(cfg.StorageDir), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newServer(cfg).routes()
+
+	if w := get(h, "/"); w.Header().Get("X-Visit-Count") != "1" || w.Header().Get("X-Storage") != "" {
+		t.Errorf("visit %q with X-Storage %q, want 1 from storage", w.Header().Get("X-Visit-Count"), w.Header().Get("X-Storage"))
+	}
+	if entry := findLog(t, logs, "counter file is corrupt, resetting it to zero"); entry["content"] != "hello" {
+		t.Errorf("corruption log = %v", entry)
+	}
+	// Overwritten once; later visits count on from there.
+	if w := get(h, "/"); w.Header().Get("X-Visit-Count") != "2" {
+		t.Errorf("next visit = %q, want 2", w.Header().Get("X-Visit-Count"))
+	}
+}
+
+func TestRootSkipCount(t *testing.T) {
+	cfg := testConfig(t)
+	h := newServer(cfg).routes()
+	get(h, "/")
+
+	if w := get(h, "/?count=false"); w.Header().Get("X-Visit-Count") != "1" {
+		t.Errorf("?count=false: visit %q, want 1", w.Header().Get("X-Visit-Count"))
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Skip-Count", "true")
+	if w := record(h, r); w.Header().Get("X-Visit-Count") != "1" {
+		t.Errorf("X-Skip-Count: visit %q, want 1", w.Header().Get("X-Visit-Count"))
+	}
+	if n, _ := newServer(cfg).visits.Get(); n != 1 {
+		t.Errorf("stored count = %d, want 1", n)
+	}
+	if w := get(h, "/"); w.Header().Get("X-Visit-Count") != "2" {
+		t.Errorf("counting visit = %q, want 2", w.Header().Get("X-Visit-Count"))
+	}
+}
+
+func TestErrorJSONMode(t *testing.T) {
+	w := get(newServer(testConfig(t)).routes(), "/error?json=1")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if got := decodeError(t, w); got["error"] != "intentional panic" || len(got) != 1 {
+		t.Errorf("body = %v, want {\"error\":\"intentional panic\"}", got)
+	}
+}
+
+func TestCounterEndpointIsReadOnly(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	visits := func() float64 {
+		var body map[string]float64
+		json.Unmarshal(get(h, "/counter").Body.Bytes(), &body)
+		return body["visits"]
+	}
+	for range 3 {
+		if n := visits(); n != 0 {
+			t.Fatalf("/counter = %v before any visit, want 0", n)
+		}
+	}
+	get(h, "/")
+	get(h, "/")
+	for range 3 {
+		if n := visits(); n != 2 {
+			t.Fatalf("/counter = %v, want 2", n)
+		}
+	}
+}
+
+func TestFaviconDoesNotCount(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BasePath = "/app"
+	h := newServer(cfg).routes()
+	if w := get(h, "/favicon.ico"); w.Code != http.StatusNoContent {
+		t.Errorf("GET /favicon.ico = %d, want 204", w.Code)
+	}
+	if w := get(h, "/app/"); w.Header().Get("X-Visit-Count") != "1" {
+		t.Errorf("first visit after the favicon = %q, want 1", w.Header().Get("X-Visit-Count"))
+	}
+}
+
+func TestRootPlaceholdersForUnsetVars(t *testing.T) {
+	logs := captureLogs(t)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	findLog(t, logs, "MESSAGE is not set")
+	findLog(t, logs, "MYSECRET is not set")
+
+	cfg.StorageDir = t.TempDir()
+	body := get(newServer(cfg).routes(), "/").Body.String()
+	if !strings.Contains(body, "Message: (unset), Secret: (unset)") {
+		t.Errorf("body = %q, want (unset) placeholders", body)
+	}
+}
+
+func TestRootIdempotencyKey(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	withKey := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Idempotency-Key", key)
+		return record(h, r)
+	}
+	first := withKey("k1")
+	retry := withKey("k1")
+	if first.Header().Get("X-Visit-Count") != "1" || retry.Header().Get("X-Visit-Count") != "1" {
+		t.Errorf("visits %q then %q, want 1 both times", first.Header().Get("X-Visit-Count"), retry.Header().Get("X-Visit-Count"))
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry not marked as replayed")
+	}
+	if w := withKey("k2"); w.Header().Get("X-Visit-Count") != "2" {
+		t.Errorf("new key: visit %q, want 2", w.Header().Get("X-Visit-Count"))
+	}
+	if w := withKey(strings.Repeat("k", maxIdempotencyKey+1)); w.Code != http.StatusBadRequest {
+		t.Errorf("oversized key: status = %d, want 400", w.Code)
+	}
+}
+
+func TestGreetingTemplate(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Message = "hello"
+	cfg.InstanceID = "i-1"
+	cfg.GreetingTemplate = "{{.Message}} from {{.Instance}}, visit {{.Visit}}"
+	if body := get(newServer(cfg).routes(), "/").Body.String(); body != "hello from i-1, visit 1" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestGreetingTemplateFallback(t *testing.T) {
+	for _, tmpl := range []string{"{{.Message", "{{.Nope}}"} {
+		logs := captureLogs(t)
+		cfg := testConfig(t)
+		cfg.GreetingTemplate = tmpl
+		body := get(newServer(cfg).routes(), "/").Body.String()
+		if !strings.HasPrefix(body, "Hi, I'm a container!") {
+			t.Errorf("template %q: body = %q, want the default greeting", tmpl, body)
+		}
+		findLog(t, logs, "invalid GREETING_TEMPLATE, using the default greeting")
+	}
+}
+
+func TestReadyDuringWarmup(t *testing.T) {
+	cfg := testConfig(t)
+	// Warm-up counts from process start, which was a while ago in a test
+	// binary.
+	cfg.Warmup = time.Since(startTime) + 200*time.Millisecond
+	h := newServer(cfg).routes()
+
+	w := get(h, "/ready")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("during warm-up: %d with Retry-After %q, want 503 and a hint", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get(h, "/health"); w.Code != http.StatusOK {
+		t.Errorf("/health during warm-up = %d, want 200", w.Code)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if w := get(h, "/ready"); w.Code != http.StatusOK {
+		t.Errorf("after warm-up: %d, want 200", w.Code)
+	}
+}
+
+func TestCountersSnapshot(t *testing.T) {
+	cfg := testConfig(t)
+	h := newServer(cfg).routes()
+	if body := get(h, "/counters").Body.String(); body != "{}\n" {
+		t.Errorf("without a counters dir: %q, want {}", body)
+	}
+
+	dir := filepath.Join(cfg.StorageDir, "counters")
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), encodeCounter(3), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("7"), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.md"), []byte("ignored"), 0o644)
+
+	var got map[string]int
+	if err := json.Unmarshal(get(h, "/counters").Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["a"] != 3 || got["b"] != 7 {
+		t.Errorf("/counters = %v, want a=3 and b=7", got)
+	}
+	var again map[string]int
+	json.Unmarshal(get(h, "/counters").Body.Bytes(), &again)
+	if again["a"] != 3 || again["b"] != 7 {
+		t.Errorf("second /counters = %v, want the counts unchanged", again)
+	}
+}
+
+func TestDisabledEndpoints(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DisableError, cfg.DisableRandom, cfg.DisableDebug = true, true, true
+	h := jsonRouteErrors(newServer(cfg).routes(), nil)
+	for _, target := range []string{"/error", "/slowpanic", "/random", "/sleep", "/echo", "/whoami"} {
+		if w := get(h, target); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, w.Code)
+		}
+	}
+	if w := get(h, "/"); w.Code != http.StatusOK {
+		t.Errorf("GET / = %d, want 200", w.Code)
+	}
+}
+
+func TestRootStatusParam(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	for target, want := range map[string]int{
+		"/?status=418": http.StatusTeapot,
+		"/?status=503": http.StatusServiceUnavailable,
+		"/?status=101": http.StatusBadRequest,
+		"/?status=600": http.StatusBadRequest,
+		"/?status=abc": http.StatusBadRequest,
+	} {
+		if w := get(h, target); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestStorageModes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StorageDir = filepath.Join(cfg.StorageDir, "nested")
+	cfg.StorageDirMode, cfg.StorageFileMode = 0o700, 0o600
+	get(newServer(cfg).routes(), "/")
+
+	for path, want := range map[string]os.FileMode{
+		cfg.StorageDir:              0o700,
+		counterPath(cfg.StorageDir): 0o600,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s: mode = %o, want %o", path, got, want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DryRun = true
+	cfg.StorageDir = filepath.Join(cfg.StorageDir, "unmounted")
+	h := newServer(cfg).routes()
+
+	for want := 1; want <= 2; want++ {
+		if got := get(h, "/").Header().Get("X-Visit-Count"); got != strconv.Itoa(want) {
+			t.Errorf("visit %d: X-Visit-Count = %q", want, got)
+		}
+	}
+	get(h, "/count/a")
+	if w := get(h, "/counters"); !strings.Contains(w.Body.String(), `"a":1`) {
+		t.Errorf("/counters = %q, want a at 1", w.Body)
+	}
+	if w := get(h, "/ready"); w.Code != http.StatusOK {
+		t.Errorf("/ready = %d, want 200", w.Code)
+	}
+
+	if _, err := os.Stat(cfg.StorageDir); !os.IsNotExist(err) {
+		t.Errorf("dry run created the storage dir: %v", err)
+	}
+}
+
+func TestUnknownPathIsNotAVisit(t *testing.T) {
+	cfg := testConfig(t)
+	h := newServer(cfg).routes()
+	for _, target := range []string{"/nonexistent", "/random-typo"} {
+		if w := get(h, target); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, w.Code)
+		}
+	}
+	if _, err := os.Stat(counterPath(cfg.StorageDir)); !os.IsNotExist(err) {
+		t.Errorf("counter file written by unknown paths: %v", err)
+	}
+	if got := get(h, "/").Header().Get("X-Visit-Count"); got != "1" {
+		t.Errorf("first real visit = %q, want 1", got)
+	}
+}
+
+func TestRootHeadWithoutStorage(t *testing.T) {
+	cfg := testConfig(t)
+	blocker := filepath.Join(cfg.StorageDir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.StorageDir = filepath.Join(blocker, "storage")
+	h := newServer(cfg).routes()
+
+	etag := get(h, "/").Header().Get("ETag")
+	for range 3 {
+		w := record(h, httptest.NewRequest(http.MethodHead, "/", nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-Storage") != "unavailable" {
+			t.Errorf("HEAD: status %d, X-Storage %q; want 200 and unavailable", w.Code, w.Header().Get("X-Storage"))
+		}
+		if got := w.Header().Get("X-Visit-Count"); got != "1" {
+			t.Errorf("HEAD: X-Visit-Count = %s, want the fallback 1", got)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("If-None-Match", etag)
+		if w := record(h, r); w.Code != http.StatusNotModified || w.Header().Get("X-Visit-Count") != "1" {
+			t.Errorf("revalidation: status %d with visit %s, want 304 and 1", w.Code, w.Header().Get("X-Visit-Count"))
+		}
+	}
+}
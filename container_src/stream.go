@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultStreamEvents = 10
+	// maxStreamEvents bounds /stream to an hour of events.
+	maxStreamEvents = 3600
+)
+
+// handleStream emits ?n=N Server-Sent Events, one per second, flushing each
+// so it reaches the client immediately. It stops early when the client
+// disconnects. Each event gets a fresh WRITE_TIMEOUT, so streams longer than
+// it aren't cut off partway through.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	n := defaultStreamEvents
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxStreamEvents {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("n must be an integer between 1 and %d", maxStreamEvents))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx-style proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; i <= n; i++ {
+		if s.cfg.WriteTimeout > 0 {
+			// Not every ResponseWriter supports deadlines; those have none
+			// to extend anyway.
+			rc.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+		}
+		fmt.Fprintf(w, "id: %d\ndata: %d\n\n", i, i)
+		if err := rc.Flush(); err != nil {
+			s.logger.Warn("stream flush failed", "error", err)
+			return
+		}
+		if i == n {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			s.logger.Info("stream cancelled", "sent", i, "requested", n)
+			return
+		}
+	}
+}
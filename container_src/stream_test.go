@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	logs := captureLogs(t)
+	srv := httptest.NewServer(newServer(testConfig(t)).routes())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/stream?n=100", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 2 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	if strings.Join(events, ",") != "1,2" {
+		t.Fatalf("events = %v, want 1 and 2", events)
+	}
+	cancel()
+
+	// Close waits for the handler, which must notice the client left
+	// rather than send the remaining 98 events.
+	srv.Close()
+	if entry := findLog(t, logs, "stream cancelled"); entry["sent"] != 2.0 {
+		t.Errorf("cancel log = %v, want 2 sent", entry)
+	}
+}
+
+func TestStreamOutlivesWriteTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WriteTimeout = 1500 * time.Millisecond
+	srv := httptest.NewUnstartedServer(newServer(cfg).routes())
+	srv.Config.WriteTimeout = cfg.WriteTimeout
+	srv.Start()
+	defer srv.Close()
+
+	// Three events take two seconds, past the server's write timeout.
+	resp, err := http.Get(srv.URL + "/stream?n=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream cut off after %q: %v", body, err)
+	}
+	if got := strings.Count(string(body), "data: "); got != 3 {
+		t.Errorf("got %d events, want 3", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+type uploadedFile struct {
+	Field    string `json:"field"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// handleUpload reads a multipart/form-data body and reports the name and
+// size of each file in it. Parts are streamed and discarded rather than
+// buffered, so memory use doesn't grow with the upload; the total size is
+// capped by MAX_BODY_BYTES.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected a multipart/form-data body")
+		return
+	}
+
+	files := []uploadedFile{}
+	fields := []string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		n, err := io.Copy(io.Discard, part)
+		part.Close()
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		if part.FileName() == "" {
+			fields = append(fields, part.FormName())
+			continue
+		}
+		files = append(files, uploadedFile{Field: part.FormName(), Filename: part.FileName(), Size: n})
+	}
+
+	s.logger.Info("upload", "request_id", RequestIDFromContext(r.Context()), "files", len(files))
+	writeJSON(w, http.StatusOK, map[string]any{
+		"files":  files,
+		"fields": fields,
+	})
+}
+
+// uploadError answers a failed multipart read: 413 when the body went over
+// the size cap, 400 for anything else.
+func uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "malformed multipart body")
+}
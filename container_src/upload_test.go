@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// multipartBody builds a form with the given files, keyed by file name.
+func multipartBody(t *testing.T, files map[string]string) (body *bytes.Buffer, contentType string) {
+	t.Helper()
+	body = new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.WriteField("note", "hi")
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestUpload(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	body, contentType := multipartBody(t, map[string]string{"a.txt": "hello", "b.bin": strings.Repeat("x", 1000)})
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	w := record(h, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var got struct {
+		Files  []uploadedFile `json:"files"`
+		Fields []string       `json:"fields"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]int64)
+	for _, f := range got.Files {
+		sizes[f.Filename] = f.Size
+	}
+	if len(sizes) != 2 || sizes["a.txt"] != 5 || sizes["b.bin"] != 1000 {
+		t.Errorf("files = %+v, want a.txt (5 bytes) and b.bin (1000 bytes)", got.Files)
+	}
+	if len(got.Fields) != 1 || got.Fields[0] != "note" {
+		t.Errorf("fields = %v, want [note]", got.Fields)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	h := maxBodyBytesMiddleware(newServer(testConfig(t)).routes(), 512)
+	body, contentType := multipartBody(t, map[string]string{"big.bin": strings.Repeat("x", 1000)})
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	r.ContentLength = -1
+	if w := record(h, r); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", w.Code)
+	}
+}
+
+func TestUploadRejectsNonMultipart(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	if w := record(h, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("plain"))); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
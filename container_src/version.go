@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Build metadata, set at link time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// startTime is when the process booted, reported by /uptime.
+var startTime = time.Now()
+
+// instanceUUID identifies this process. Unlike CLOUDFLARE_DEPLOYMENT_ID it
+// changes on every restart.
+var instanceUUID = newUUID()
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	})
+}
+
+func (s *Server) handleUptime(w http.ResponseWriter, r *http.Request) {
+	uptime := time.Since(startTime)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"start_time":     startTime.UTC().Format(time.RFC3339Nano),
+		"uptime":         uptime.Round(time.Millisecond).String(),
+		"uptime_seconds": uptime.Seconds(),
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+	version, commit, buildTime = "1.2.3", "abc123", "2025-06-23T00:00:00Z"
+
+	var got map[string]string
+	if err := json.Unmarshal(get(newServer(testConfig(t)).routes(), "/version").Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"version": "1.2.3", "commit": "abc123", "build_time": "2025-06-23T00:00:00Z"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestUptimeIncreases(t *testing.T) {
+	h := newServer(testConfig(t)).routes()
+	uptime := func() (start string, secs float64) {
+		var body struct {
+			StartTime     string  `json:"start_time"`
+			UptimeSeconds float64 `json:"uptime_seconds"`
+		}
+		if err := json.Unmarshal(get(h, "/uptime").Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.StartTime, body.UptimeSeconds
+	}
+	start1, first := uptime()
+	time.Sleep(10 * time.Millisecond)
+	start2, second := uptime()
+	if first < 0 || second <= first {
+		t.Errorf("uptime went from %v to %v, want non-negative and increasing", first, second)
+	}
+	if start1 != start2 {
+		t.Errorf("start_time changed from %s to %s", start1, start2)
+	}
+}